@@ -0,0 +1,277 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Statistic used to combine the datapoints for a series within a step.
+type aggregationStat int
+
+const (
+	statMax aggregationStat = iota
+	statSum
+	statAvg
+	statLast
+)
+
+// Parse the name of a statistic as used in the config.
+func parseAggregationStat(s string) (aggregationStat, error) {
+	switch s {
+	case "max":
+		return statMax, nil
+	case "sum":
+		return statSum, nil
+	case "avg":
+		return statAvg, nil
+	case "last":
+		return statLast, nil
+	default:
+		return statLast, fmt.Errorf("invalid aggregation stat '%s', must be one of: max, sum, avg, last", s)
+	}
+}
+
+// Returns the statistic to use if there is no matching rule. It is based on
+// the atlas.dstype so that rates are averaged, sums are added, and gauges
+// keep the most recent value as Atlas would without aggregation. Gauges for
+// the max of a distribution keep the largest value.
+func defaultAggregationStat(tags map[string]string) aggregationStat {
+	if tags["statistic"] == "max" {
+		return statMax
+	}
+	switch tags[dstypeTag] {
+	case "rate":
+		return statAvg
+	case "sum":
+		return statSum
+	default:
+		return statLast
+	}
+}
+
+// Maps metrics with a name matching the pattern to a statistic.
+type aggregationRule struct {
+	pattern *regexp.Regexp
+	stat    aggregationStat
+}
+
+// Rules for determining the statistic used for a metric. The first rule with
+// a pattern matching the name tag is used.
+type aggregationRules []aggregationRule
+
+// Parse the rules from a JSON array of objects with a pattern and stat,
+// e.g.: [{"pattern": "^cpu\\.", "stat": "max"}].
+func parseAggregationRules(s string) (aggregationRules, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var specs []struct {
+		Pattern string `json:"pattern"`
+		Stat    string `json:"stat"`
+	}
+	if err := json.Unmarshal([]byte(s), &specs); err != nil {
+		return nil, fmt.Errorf("invalid aggregation rules: %v", err)
+	}
+
+	var rules aggregationRules
+	for _, spec := range specs {
+		r, err := regexp.Compile(spec.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aggregation pattern '%s': %v", spec.Pattern, err)
+		}
+		stat, err := parseAggregationStat(spec.Stat)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, aggregationRule{r, stat})
+	}
+	return rules, nil
+}
+
+// Returns the statistic for a metric.
+func (r aggregationRules) stat(tags map[string]string) aggregationStat {
+	for _, rule := range r {
+		if rule.pattern.MatchString(tags["name"]) {
+			return rule.stat
+		}
+	}
+	return defaultAggregationStat(tags)
+}
+
+// Accumulated state for a single series within a step.
+type aggregationBucket struct {
+	tags     map[string]string
+	stat     aggregationStat
+	count    int
+	sum      float64
+	max      float64
+	last     float64
+	lastTime uint64
+}
+
+func (b *aggregationBucket) update(m Metric) {
+	if b.count == 0 || m.Value > b.max {
+		b.max = m.Value
+	}
+	if b.count == 0 || m.Timestamp >= b.lastTime {
+		b.last = m.Value
+		b.lastTime = m.Timestamp
+	}
+	b.sum += m.Value
+	b.count++
+}
+
+func (b *aggregationBucket) value() float64 {
+	switch b.stat {
+	case statMax:
+		return b.max
+	case statSum:
+		return b.sum
+	case statAvg:
+		return b.sum / float64(b.count)
+	default:
+		return b.last
+	}
+}
+
+// Combines datapoints for each series into a single value per step. Atlas
+// stores one value per step and keeps the last write, so without aggregation
+// all but one sample would be lost if the collection interval is shorter than
+// the step.
+type aggregator struct {
+	step uint64
+
+	mutex   sync.Mutex
+	buckets map[uint64]map[string]*aggregationBucket
+
+	// Start of the most recent step that has been flushed. Datapoints for
+	// this step or earlier arrive too late and are dropped.
+	flushed uint64
+
+	// Client used for the most recent publish. It is used to send the steps
+	// that are still in progress when the publisher is closed.
+	client AtlasClient
+}
+
+func newAggregator(step time.Duration) *aggregator {
+	return &aggregator{
+		step:    uint64(step / time.Millisecond),
+		buckets: make(map[uint64]map[string]*aggregationBucket),
+	}
+}
+
+// Add datapoints to the buckets for the steps they fall in.
+func (a *aggregator) add(metrics []Metric, rules aggregationRules) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	late := 0
+	for _, m := range metrics {
+		start := m.Timestamp - m.Timestamp%a.step
+		if a.flushed > 0 && start <= a.flushed {
+			late++
+			continue
+		}
+
+		series, ok := a.buckets[start]
+		if !ok {
+			series = make(map[string]*aggregationBucket)
+			a.buckets[start] = series
+		}
+		key := tagsKey(m.Tags)
+		bucket, ok := series[key]
+		if !ok {
+			bucket = &aggregationBucket{tags: m.Tags, stat: rules.stat(m.Tags)}
+			series[key] = bucket
+		}
+		bucket.update(m)
+	}
+
+	if late > 0 {
+		logger := log.New()
+		logger.Warnf("dropped %d datapoints for steps that have already been flushed", late)
+	}
+}
+
+// Return the aggregated datapoints for all steps that have completed as of
+// the specified time. The timestamp for each datapoint is the start of the
+// step. Steps that are still in progress are kept until a later flush.
+func (a *aggregator) flush(now time.Time) []Metric {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.flushUntil(uint64(now.Unix() * 1000))
+}
+
+// Return the aggregated datapoints for all steps including those that are
+// still in progress along with the client that should be used to send them.
+// This is used when shutting down so the partial steps are not lost.
+func (a *aggregator) flushAll() ([]Metric, AtlasClient) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.flushUntil(math.MaxUint64), a.client
+}
+
+// Set the client to use when flushing the remaining steps.
+func (a *aggregator) setClient(client AtlasClient) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.client = client
+}
+
+// Flush the steps that end at or before the specified time in milliseconds.
+// Must be called with the lock held.
+func (a *aggregator) flushUntil(nowMillis uint64) []Metric {
+	var starts []uint64
+	for start := range a.buckets {
+		if start+a.step <= nowMillis || nowMillis == math.MaxUint64 {
+			starts = append(starts, start)
+		}
+	}
+	sort.Sort(uint64s(starts))
+
+	var metrics []Metric
+	for _, start := range starts {
+		series := a.buckets[start]
+		keys := make([]string, 0, len(series))
+		for k := range series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			bucket := series[k]
+			metrics = append(metrics, Metric{bucket.tags, start, bucket.value()})
+		}
+		delete(a.buckets, start)
+		a.flushed = start
+	}
+	return metrics
+}
+
+type uint64s []uint64
+
+func (s uint64s) Len() int           { return len(s) }
+func (s uint64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
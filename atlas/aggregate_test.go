@@ -0,0 +1,132 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAggregate(t *testing.T) {
+
+	Convey("parseAggregationStat", t, func() {
+		for name, stat := range map[string]aggregationStat{"max": statMax, "sum": statSum, "avg": statAvg, "last": statLast} {
+			s, err := parseAggregationStat(name)
+			So(err, ShouldBeNil)
+			So(s, ShouldEqual, stat)
+		}
+		_, err := parseAggregationStat("min")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("parseAggregationRules", t, func() {
+		rules, err := parseAggregationRules("")
+		So(err, ShouldBeNil)
+		So(rules.stat(map[string]string{"name": "foo"}), ShouldEqual, statLast)
+		So(rules.stat(map[string]string{"name": "foo", "atlas.dstype": "rate"}), ShouldEqual, statAvg)
+		So(rules.stat(map[string]string{"name": "foo", "atlas.dstype": "sum"}), ShouldEqual, statSum)
+		So(rules.stat(map[string]string{"name": "foo", "statistic": "max", "atlas.dstype": "gauge"}), ShouldEqual, statMax)
+
+		rules, err = parseAggregationRules(`[{"pattern": "^cpu", "stat": "max"}]`)
+		So(err, ShouldBeNil)
+		So(rules.stat(map[string]string{"name": "cpu.user", "atlas.dstype": "rate"}), ShouldEqual, statMax)
+		So(rules.stat(map[string]string{"name": "mem.free"}), ShouldEqual, statLast)
+
+		_, err = parseAggregationRules(`[{"pattern": "(cpu", "stat": "max"}]`)
+		So(err, ShouldNotBeNil)
+		_, err = parseAggregationRules(`[{"pattern": "cpu", "stat": "min"}]`)
+		So(err, ShouldNotBeNil)
+		_, err = parseAggregationRules(`foo`)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("aggregator", t, func() {
+		rules, _ := parseAggregationRules(`[
+			{"pattern": "^max$", "stat": "max"},
+			{"pattern": "^sum$", "stat": "sum"},
+			{"pattern": "^avg$", "stat": "avg"},
+			{"pattern": "^last$", "stat": "last"}
+		]`)
+
+		var input []Metric
+		for _, name := range []string{"max", "sum", "avg", "last"} {
+			tags := map[string]string{"name": name}
+			input = append(input,
+				Metric{tags, 60000, 1.0},
+				Metric{tags, 90000, 5.0},
+				Metric{tags, 80000, 3.0},
+				Metric{tags, 120000, 7.0})
+		}
+
+		agg := newAggregator(time.Minute)
+		agg.add(input, rules)
+
+		// Nothing is complete yet
+		So(agg.flush(time.Unix(119, 0)), ShouldBeEmpty)
+
+		So(agg.flush(time.Unix(120, 0)), ShouldResemble, []Metric{
+			Metric{map[string]string{"name": "avg"}, 60000, 3.0},
+			Metric{map[string]string{"name": "last"}, 60000, 5.0},
+			Metric{map[string]string{"name": "max"}, 60000, 5.0},
+			Metric{map[string]string{"name": "sum"}, 60000, 9.0},
+		})
+
+		// Late data for a flushed step is dropped
+		agg.add([]Metric{Metric{map[string]string{"name": "max"}, 100000, 100.0}}, rules)
+		So(agg.flush(time.Unix(180, 0)), ShouldResemble, []Metric{
+			Metric{map[string]string{"name": "avg"}, 120000, 7.0},
+			Metric{map[string]string{"name": "last"}, 120000, 7.0},
+			Metric{map[string]string{"name": "max"}, 120000, 7.0},
+			Metric{map[string]string{"name": "sum"}, 120000, 7.0},
+		})
+		So(agg.flush(time.Unix(600, 0)), ShouldBeEmpty)
+	})
+
+	Convey("aggregator separates series by tags", t, func() {
+		agg := newAggregator(time.Minute)
+		agg.add([]Metric{
+			Metric{map[string]string{"name": "foo", "id": "a"}, 1000, 1.0},
+			Metric{map[string]string{"name": "foo", "id": "b"}, 2000, 2.0},
+			Metric{map[string]string{"name": "foo", "id": "a"}, 3000, 3.0},
+		}, nil)
+		So(agg.flush(time.Unix(60, 0)), ShouldResemble, []Metric{
+			Metric{map[string]string{"name": "foo", "id": "a"}, 0, 3.0},
+			Metric{map[string]string{"name": "foo", "id": "b"}, 0, 2.0},
+		})
+	})
+
+	Convey("aggregator flushAll includes steps in progress", t, func() {
+		agg := newAggregator(time.Minute)
+		agg.add([]Metric{
+			Metric{map[string]string{"name": "foo"}, 61000, 1.0},
+			Metric{map[string]string{"name": "foo"}, 121000, 2.0},
+		}, nil)
+
+		metrics, client := agg.flushAll()
+		So(client, ShouldBeNil)
+		So(metrics, ShouldResemble, []Metric{
+			Metric{map[string]string{"name": "foo"}, 60000, 1.0},
+			Metric{map[string]string{"name": "foo"}, 120000, 2.0},
+		})
+		So(agg.flush(time.Unix(1000, 0)), ShouldBeEmpty)
+
+		agg.setClient(NewAtlasClient("http://localhost", nil))
+		_, client = agg.flushAll()
+		So(client, ShouldNotBeNil)
+	})
+}
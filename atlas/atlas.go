@@ -17,13 +17,18 @@ package atlas
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 
@@ -44,15 +49,275 @@ var ignoredTags = map[string]bool{
 	"plugin_running_on": true,
 }
 
+// Settings used when creating the Atlas tags for a metric.
+type tagOptions struct {
+	// Keys for snap tags that will not be copied to the Atlas tags.
+	ignored map[string]bool
+
+	// Keys for snap tags that will be renamed when copied to the Atlas tags.
+	// A mapped tag is copied even if it is also in the ignored set.
+	mapping map[string]string
+
+	// Rules for naming metrics based on the namespace.
+	names nameRules
+
+	// If true, then referring to an unknown variable in a template is an
+	// error and the metric will be dropped.
+	strict bool
+
+	// Parsed templates for the tag values on the metrics.
+	templates *templateCache
+
+	// Rules for setting the atlas.dstype tag. If nil, then the tag will only
+	// be present if it was set on the input metric.
+	dstypes *dstypeRules
+}
+
+// Settings used if none are specified.
+var defaultTagOptions = &tagOptions{ignored: ignoredTags, templates: newTemplateCache()}
+
 type atlasPublisher struct {
+	httpClients *httpClientPool
+
+	mutex       sync.Mutex
+	stats       map[string]*ClientStats
+	senders     map[string]*asyncSender
+	spools      map[string]*Spool
+	spoolErrors map[string]spoolError
+	rates       map[string]*rateTracker
+	aggregators map[aggregatorKey]*aggregator
+	compiled    map[string]*compiledConfig
+	limiters    map[string]*RequestLimiter
 }
 
 func NewAtlasPublisher() *atlasPublisher {
-	return &atlasPublisher{}
+	return &atlasPublisher{
+		httpClients: newHTTPClientPool(),
+		stats:       make(map[string]*ClientStats),
+		senders:     make(map[string]*asyncSender),
+		spools:      make(map[string]*Spool),
+		spoolErrors: make(map[string]spoolError),
+		rates:       make(map[string]*rateTracker),
+		aggregators: make(map[aggregatorKey]*aggregator),
+		compiled:    make(map[string]*compiledConfig),
+		limiters:    make(map[string]*RequestLimiter),
+	}
+}
+
+// Get the compiled patterns and rules for the config. The result is cached
+// so the config is only validated and compiled the first time it is used.
+// Snap does not allow custom validation of the config values when the task is
+// created, so an invalid config will cause the first publish to fail.
+func (f *atlasPublisher) getCompiledConfig(config map[string]ctypes.ConfigValue) (*compiledConfig, error) {
+	key := configKey(config)
+
+	f.mutex.Lock()
+	compiled, ok := f.compiled[key]
+	f.mutex.Unlock()
+	if ok {
+		return compiled, nil
+	}
+
+	compiled, err := compileConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.compiled) >= maxCompiledConfigs {
+		f.compiled = make(map[string]*compiledConfig)
+	}
+	f.compiled[key] = compiled
+	return compiled, nil
+}
+
+// Aggregators are kept for each combination of URI, step, and config so that
+// tasks publishing to the same URI do not interfere with each other. Each
+// aggregator is flushed with the client and common tags for its own task.
+type aggregatorKey struct {
+	uri    string
+	step   time.Duration
+	config string
+}
+
+// Get the aggregator for a given URI, step, and config key.
+func (f *atlasPublisher) getAggregator(uri string, step time.Duration, config string) *aggregator {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := aggregatorKey{uri, step, config}
+	agg, ok := f.aggregators[key]
+	if !ok {
+		agg = newAggregator(step)
+		f.aggregators[key] = agg
+	}
+	return agg
+}
+
+// Get the limiter for concurrent requests to a given URI. The same limiter is
+// always used for a URI so the bound holds for requests already in flight.
+// If tasks publishing to the URI use different sizes, then the limiter is
+// resized in place to the largest of them.
+func (f *atlasPublisher) getLimiter(uri string, size int) *RequestLimiter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	limiter, ok := f.limiters[uri]
+	if !ok {
+		limiter = NewRequestLimiter(size)
+		f.limiters[uri] = limiter
+	} else if size > limiter.Size() {
+		limiter.resize(size)
+	}
+	return limiter
+}
+
+// Get the state for converting counters to rates for a given URI.
+func (f *atlasPublisher) getRateTracker(uri string) *rateTracker {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	rates, ok := f.rates[uri]
+	if !ok {
+		rates = newRateTracker()
+		f.rates[uri] = rates
+	}
+	return rates
+}
+
+// Get the stats for a given URI. The stats are kept for the life of the
+// publisher so they accumulate across calls to Publish.
+func (f *atlasPublisher) getStats(uri string) *ClientStats {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	stats, ok := f.stats[uri]
+	if !ok {
+		stats = &ClientStats{}
+		f.stats[uri] = stats
+	}
+	return stats
+}
+
+// Minimum amount of time to wait before trying to open a spool again after
+// it failed.
+const spoolRetryInterval = time.Minute
+
+// Failure to open the spool for a URI.
+type spoolError struct {
+	options SpoolOptions
+	time    time.Time
+}
+
+// Get the spool for a given URI. The spool is opened the first time it is
+// used and kept open for the life of the publisher. If the directory has
+// changed, then the existing spool will be closed and a new one opened. The
+// spool is optional, so if it cannot be opened the error is logged and nil is
+// returned so the datapoints can still be sent. Opening is not attempted
+// again until the retry interval has passed.
+func (f *atlasPublisher) getSpool(uri string, options SpoolOptions, stats *ClientStats) *Spool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	spool, ok := f.spools[uri]
+	if ok && spool.options == options {
+		return spool
+	}
+	if ok {
+		spool.Close()
+		delete(f.spools, uri)
+	}
+
+	now := time.Now()
+	if e, ok := f.spoolErrors[uri]; ok && e.options == options && now.Sub(e.time) < spoolRetryInterval {
+		return nil
+	}
+
+	spool, err := OpenSpool(options)
+	if err != nil {
+		logger := log.New()
+		logger.Errorf("failed to open spool in %s, sending without it: %v", options.Dir, err)
+		stats.recordSpoolError()
+		f.spoolErrors[uri] = spoolError{options, now}
+		return nil
+	}
+	delete(f.spoolErrors, uri)
+	f.spools[uri] = spool
+	return spool
+}
+
+// Get the background sender for a given URI. If the settings have changed,
+// then the existing sender will be flushed and replaced.
+func (f *atlasPublisher) getSender(uri string, client AtlasClient, options senderOptions) *asyncSender {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	sender, ok := f.senders[uri]
+	if ok && sender.options == options {
+		sender.setClient(client)
+		return sender
+	}
+	if ok {
+		go sender.close()
+	}
+	sender = newAsyncSender(uri, client, options)
+	f.senders[uri] = sender
+	return sender
+}
+
+// Flush any queued metrics and release resources held by the publisher. This
+// should be called before the plugin exits.
+func (f *atlasPublisher) Close() error {
+	f.mutex.Lock()
+	senders := f.senders
+	f.senders = make(map[string]*asyncSender)
+	aggregators := f.aggregators
+	f.aggregators = make(map[aggregatorKey]*aggregator)
+	f.mutex.Unlock()
+
+	// Send the steps that are still in progress so they are not lost
+	var firstErr error
+	for _, agg := range aggregators {
+		metrics, client := agg.flushAll()
+		if len(metrics) > 0 && client != nil {
+			if err := client.Publish(metrics); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	for _, sender := range senders {
+		if err := sender.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	f.mutex.Lock()
+	for uri, spool := range f.spools {
+		spool.Close()
+		delete(f.spools, uri)
+	}
+	f.mutex.Unlock()
+
+	f.httpClients.close()
+	return firstErr
+}
+
+// Returned when the value of a metric cannot be converted to a number.
+type nonNumericError struct {
+	value interface{}
+}
+
+func (e *nonNumericError) Error() string {
+	return fmt.Sprintf("not a number: '%v' %T", e.value, e.value)
 }
 
 // TODO: there is bound to be a better way
-func toNumber(v interface{}) (float64, error) {
+//
+// Bools are converted to 0 or 1. Strings are looked up in the mapping of
+// enum values and otherwise parsed as a number.
+func toNumber(v interface{}, mapping map[string]float64) (float64, error) {
 	switch i := v.(type) {
 	case int:
 		return float64(i), nil
@@ -78,76 +343,67 @@ func toNumber(v interface{}) (float64, error) {
 		return float64(i), nil
 	case float64:
 		return float64(i), nil
+	case bool:
+		if i {
+			return 1.0, nil
+		}
+		return 0.0, nil
+	case string:
+		if n, ok := mapping[i]; ok {
+			return n, nil
+		}
+		if n, err := strconv.ParseFloat(strings.TrimSpace(i), 64); err == nil {
+			return n, nil
+		}
+		return math.NaN(), &nonNumericError{v}
 	default:
-		return math.NaN(), errors.New(fmt.Sprintf("not a number: '%v' %T", v, v))
-	}
-}
-
-// Normalize to base unit.
-func convertToBaseUnit(unit string, value float64) float64 {
-	switch unit {
-	case "ns": // nanoseconds
-		return value / 1e9
-	case "us": // microseconds
-		return value / 1e6
-	case "ms": // milliseconds
-		return value / 1e3
-
-	// Metric prefixes
-	case "k":
-		return value * 1e3
-	case "M":
-		return value * 1e6
-	case "G":
-		return value * 1e9
-	case "T":
-		return value * 1e12
-	case "P":
-		return value * 1e15
-	case "E":
-		return value * 1e18
-	case "Z":
-		return value * 1e21
-	case "Y":
-		return value * 1e24
-
-	// Binary prefixes
-	case "Ki":
-		return value * math.Pow(1024.0, 1)
-	case "Mi":
-		return value * math.Pow(1024.0, 2)
-	case "Gi":
-		return value * math.Pow(1024.0, 3)
-	case "Ti":
-		return value * math.Pow(1024.0, 4)
-	case "Pi":
-		return value * math.Pow(1024.0, 5)
-	case "Ei":
-		return value * math.Pow(1024.0, 6)
-	case "Zi":
-		return value * math.Pow(1024.0, 7)
-	case "Yi":
-		return value * math.Pow(1024.0, 8)
+		return math.NaN(), &nonNumericError{v}
+	}
+}
 
-	default:
-		return value
+// Settings used when converting the value of a metric.
+type valueOptions struct {
+	// Numeric values to use for enum strings.
+	mapping map[string]float64
+
+	// If true, then data units are converted to bits instead of bytes.
+	bits bool
+
+	// Key for a tag with the normalized unit. If empty, then the unit will
+	// not be included in the Atlas tags.
+	unitTag string
+}
+
+// Settings used if none are specified.
+var defaultValueOptions = &valueOptions{}
+
+// Returns the unit for a metric. The unit tag takes precedence over the unit
+// in the metric type.
+func metricUnit(metric plugin.MetricType) string {
+	if u, ok := metric.Tags()["unit"]; ok {
+		return u
 	}
+	return metric.Unit()
 }
 
 // Replaces variables in the pattern string with matching values from the
-// passed in map. Variables are indicated using braces, e.g.: {varname}.
+// passed in map. Variables are indicated using braces, e.g.: {varname}. See
+// parseTemplate for the full syntax. Variables that are not in the map are
+// left unchanged.
 func substitute(pattern string, vars map[string]string) string {
-	tmp := pattern
-	for k, v := range vars {
-		vname := fmt.Sprintf("{%s}", k)
-		tmp = strings.Replace(tmp, vname, v, -1)
-	}
-	return tmp
+	v, _ := expandTemplate(pattern, vars, false)
+	return v
 }
 
 // Create the Atlas tag map from the tags and namespace of the input
-// MetricType.
-func createAtlasTags(namespace core.Namespace, tags map[string]string) map[string]string {
+// MetricType. If options is nil, then the default settings will be used. An
+// error is returned if strict templates are enabled and a tag value refers
+// to an unknown variable.
+func createAtlasTags(namespace core.Namespace, tags map[string]string, options *tagOptions) (map[string]string, error) {
+	if options == nil {
+		options = defaultTagOptions
+	}
+
 	// Convert namespace to variable map
 	vars := map[string]string{
 		"namespace": strings.Join(namespace.Strings(), "."),
@@ -169,30 +425,83 @@ func createAtlasTags(namespace core.Namespace, tags map[string]string) map[strin
 	}
 	vars["namespace_static"] = strings.Join(staticNamespace, ".")
 
+	var firstErr error
+	record := func(v string, err error) string {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return v
+	}
+	expand := func(pattern string) string {
+		if options.templates == nil {
+			return record(expandTemplate(pattern, vars, options.strict))
+		}
+		return record(options.templates.expand(pattern, vars, options.strict))
+	}
+
 	// By default use the parts of the namespace to form the name. If an explicit
 	// 'name' key is used in the tags, then it will overwrite this value.
 	atlasTags := map[string]string{
 		"name": vars["namespace"],
 	}
 
-	// Copy tags that are not explicitly ignored into the Atlas tag map.
+	// Apply the first matching name rule. Tags on the metric will overwrite
+	// the values from the rule.
+	if rule := options.names.match(namespace.String(), vars); rule != nil {
+		if rule.name != nil {
+			atlasTags["name"] = record(rule.name.expand(vars, options.strict))
+		}
+		for k, t := range rule.tags {
+			atlasTags[k] = record(t.expand(vars, options.strict))
+		}
+	}
+
+	// Copy tags that are not explicitly ignored or mapped into the Atlas tag
+	// map.
+	for k, v := range tags {
+		_, ignored := options.ignored[k]
+		_, mapped := options.mapping[k]
+		if !ignored && !mapped {
+			atlasTags[k] = expand(v)
+		}
+	}
+
+	// Add mapped tags using the new key. If the metric also has a tag with
+	// the new key, then the explicit tag takes precedence.
 	for k, v := range tags {
-		if _, ignored := ignoredTags[k]; !ignored {
-			atlasTags[k] = substitute(v, vars)
+		if newKey, ok := options.mapping[k]; ok {
+			if _, explicit := tags[newKey]; !explicit {
+				atlasTags[newKey] = expand(v)
+			}
 		}
 	}
 
-	return atlasTags
+	// Set the data source type unless it was explicitly set on the metric.
+	if _, ok := atlasTags[dstypeTag]; !ok && options.dstypes != nil {
+		atlasTags[dstypeTag] = options.dstypes.dstype(namespace.String())
+	}
+
+	return atlasTags, firstErr
 }
 
 // Convert a snap MetricType value to an Atlas metric.
-func toAtlasMetric(metric plugin.MetricType) *Metric {
-	tags := createAtlasTags(metric.Namespace(), metric.Tags())
-	v, err := toNumber(metric.Data())
+// Returns an error if the value cannot be converted to a number or a tag
+// template cannot be expanded.
+func toAtlasMetric(metric plugin.MetricType, options *tagOptions, values *valueOptions) (*Metric, error) {
+	if values == nil {
+		values = defaultValueOptions
+	}
+	tags, err := createAtlasTags(metric.Namespace(), metric.Tags(), options)
+	if err != nil {
+		return nil, err
+	}
+	v, err := toNumber(metric.Data(), values.mapping)
 	if err == nil {
-		unit, ok := metric.Tags()["unit"]
-		if ok {
-			v = convertToBaseUnit(unit, v)
+		if u, ok := parseUnit(metricUnit(metric), values.bits); ok {
+			v = u.convert(v)
+			if values.unitTag != "" && u.name != "" {
+				tags[values.unitTag] = u.name
+			}
 		}
 
 		m := Metric{
@@ -200,50 +509,131 @@ func toAtlasMetric(metric plugin.MetricType) *Metric {
 			uint64(metric.Timestamp().Unix() * 1000),
 			v,
 		}
-		return &m
+		return &m, nil
 	} else {
-		return nil
+		return nil, err
+	}
+}
+
+// Settings and state used for converting snap metrics to Atlas metrics.
+type converter struct {
+	// Pattern on the namespace for metrics that are monotonically increasing
+	// counters. May be nil.
+	counters *regexp.Regexp
+
+	// State used to convert counters to rates. If nil, then counters will
+	// be passed through unchanged.
+	rates *rateTracker
+
+	// Settings for creating the Atlas tags. If nil, then the defaults will
+	// be used.
+	tagOptions *tagOptions
+
+	// Rules for rewriting the tags after the Atlas tag map is created.
+	tagRules tagRules
+
+	// Settings for converting the values. If nil, then the defaults will be
+	// used.
+	values *valueOptions
+
+	// Stats for recording dropped datapoints. May be nil.
+	stats *ClientStats
+
+	// Number of datapoints dropped because the value was not numeric,
+	// by namespace.
+	dropped map[string]int
+}
+
+// Returns true if the metric is a monotonically increasing counter based on
+// the namespace pattern or a tag of type=counter.
+func (c *converter) isCounter(metric plugin.MetricType) bool {
+	if metric.Tags()["type"] == "counter" {
+		return true
 	}
+	return c.counters != nil && c.counters.MatchString(metric.Namespace().String())
 }
 
-// Convert input metric array to Atlas metric type.
-func toAtlasMetrics(metrics []plugin.MetricType) []Metric {
+// Convert input metric array to Atlas metric type. The tag rules are applied
+// to each metric and then counters will be converted to a per-second rate. No
+// datapoint is emitted for the first sample of a counter or after it is reset.
+// Metrics with a slice or map value are expanded to percentile series. If a
+// distribution is a counter, then the values are cumulative and the count,
+// total, and percentile series will be converted to a per-second rate.
+// Otherwise, they are treated as the deltas for the interval.
+func (c *converter) toAtlasMetrics(metrics []plugin.MetricType) []Metric {
+	logger := log.New()
 	var atlasMetrics []Metric
 	for i := range metrics {
-		m := toAtlasMetric(metrics[i])
-		if m != nil {
-			atlasMetrics = append(atlasMetrics, *m)
+		if isDistribution(metrics[i].Data()) {
+			ms, err := toDistributionMetrics(metrics[i], c.tagOptions, c.values)
+			if err != nil {
+				logger.Warnf("dropping %s: %v", metrics[i].Namespace().String(), err)
+				if c.stats != nil {
+					c.stats.recordDropped(dropInvalid, 1)
+				}
+				continue
+			}
+			cumulative := c.rates != nil && c.isCounter(metrics[i])
+			for j := range ms {
+				m := &ms[j]
+				isSum := m.Tags[dstypeTag] == "sum"
+				c.tagRules.apply(m.Tags)
+				if cumulative && isSum {
+					rate, ok := c.rates.rate(*m)
+					if !ok {
+						continue
+					}
+					m.Tags[dstypeTag] = "rate"
+					m.Value = rate
+				}
+				atlasMetrics = append(atlasMetrics, *m)
+			}
+			continue
 		}
-	}
-	return atlasMetrics
-}
 
-// Get the exclude regex or return nil if it is not present or was an invalid
-// expression.
-func getExclude(logger *log.Logger, config map[string]ctypes.ConfigValue) *regexp.Regexp {
-	if cfgValue, ok := config["exclude"]; ok {
-		exclude := cfgValue.(ctypes.ConfigValueStr).Value
-		r, err := regexp.Compile(exclude)
-		if err != nil {
-			logger.Warn("failed to compile exclude pattern '%s': %v", exclude, err)
-			return nil
-		} else {
-			return r
+		m, err := toAtlasMetric(metrics[i], c.tagOptions, c.values)
+		if _, ok := err.(*nonNumericError); ok {
+			if c.dropped == nil {
+				c.dropped = make(map[string]int)
+			}
+			c.dropped[metrics[i].Namespace().String()]++
+			if c.stats != nil {
+				c.stats.recordDropped(dropNonNumeric, 1)
+			}
+			continue
+		} else if err != nil {
+			logger.Warnf("dropping %s: %v", metrics[i].Namespace().String(), err)
+			if c.stats != nil {
+				c.stats.recordDropped(dropInvalid, 1)
+			}
+			continue
 		}
-	} else {
-		return nil
+		c.tagRules.apply(m.Tags)
+		if c.rates != nil && c.isCounter(metrics[i]) {
+			rate, ok := c.rates.rate(*m)
+			if !ok {
+				continue
+			}
+			m.Tags[dstypeTag] = "rate"
+			m.Value = rate
+		}
+		atlasMetrics = append(atlasMetrics, *m)
+	}
+
+	for ns, n := range c.dropped {
+		logger.Debugf("dropped %d non-numeric datapoints for %s", n, ns)
 	}
+	return atlasMetrics
 }
 
-// Filter out all metrics that match the regex.
-func filterNot(metrics []plugin.MetricType, re *regexp.Regexp) []plugin.MetricType {
-	if re == nil {
+// Filter out all metrics that are not kept by the filter.
+func filterMetrics(metrics []plugin.MetricType, f *metricFilter) []plugin.MetricType {
+	if f == nil {
 		return metrics
 	} else {
 		filtered := []plugin.MetricType{}
 		for _, m := range metrics {
-			name := m.Namespace().String()
-			if !re.MatchString(name) {
+			if f.keep(m) {
 				filtered = append(filtered, m)
 			}
 		}
@@ -268,8 +658,19 @@ func (f *atlasPublisher) Publish(contentType string, content []byte, config map[
 	logger.Println("Publishing started")
 	var metrics []plugin.MetricType
 
-	uri := substitute(config["uri"].(ctypes.ConfigValueStr).Value, getenv())
-	exclude := getExclude(logger, config)
+	env := getenv()
+	uri := substitute(config["uri"].(ctypes.ConfigValueStr).Value, env)
+	compiled, err := f.getCompiledConfig(config)
+	if err != nil {
+		logger.Printf("Error invalid config: %v", err)
+		return err
+	}
+
+	commonTags, err := getCommonTags(config, env)
+	if err != nil {
+		logger.Printf("Error %v", err)
+		return err
+	}
 
 	logger.Printf("URI %v", uri)
 
@@ -280,21 +681,98 @@ func (f *atlasPublisher) Publish(contentType string, content []byte, config map[
 			logger.Printf("Error decoding: error=%v content=%v", err, content)
 			return err
 		}
+	case plugin.SnapJSONContentType:
+		if err := json.Unmarshal(content, &metrics); err != nil {
+			logger.Printf("Error decoding: error=%v content=%s", err, content)
+			return err
+		}
 	default:
 		logger.Printf("Error unknown content type '%v'", contentType)
 		return errors.New(fmt.Sprintf("Unknown content type '%s'", contentType))
 	}
 
 	// Filter and convert to Atlas data model
-	atlasMetrics := toAtlasMetrics(filterNot(metrics, exclude))
-	client := NewAtlasClient(uri, map[string]string {})
-	client.Publish(atlasMetrics)
+	stats := f.getStats(uri)
+	stats.recordReceived(len(metrics))
+	filtered := filterMetrics(metrics, compiled.filter)
+	stats.recordDropped(dropExcluded, len(metrics)-len(filtered))
+
+	rates := f.getRateTracker(uri)
+	rates.expire(time.Now())
+	conv := &converter{
+		counters:   compiled.counters,
+		rates:      rates,
+		tagOptions: compiled.tagOptions,
+		tagRules:   compiled.tagRules,
+		values:     compiled.values,
+		stats:      stats,
+	}
+	atlasMetrics := conv.toAtlasMetrics(filtered)
+	stats.recordConverted(len(atlasMetrics))
+
+	// Combine datapoints within a step so samples are not lost when the task
+	// interval is shorter than the Atlas step
+	var agg *aggregator
+	if step := getMillis(config, "step_ms", 0); step > 0 {
+		agg = f.getAggregator(uri, step, configKey(config))
+		agg.add(atlasMetrics, compiled.aggregation)
+		atlasMetrics = agg.flush(time.Now())
+	}
+
+	options := compiled.client
+	options.HTTPClient = f.httpClients.get(uri, compiled.http)
+	options.Stats = stats
+	options.Limiter = f.getLimiter(uri, options.MaxConcurrency)
 
-	return nil
+	if spoolOptions := compiled.spool; spoolOptions.Dir != "" {
+		spoolOptions.Dir = getSpoolDir(spoolOptions.Dir, uri, env)
+		options.Spool = f.getSpool(uri, spoolOptions, stats)
+	}
+
+	// Self-metrics are sent along with the datapoints from snap
+	if interval := getMillis(config, "self_metrics_interval_ms", defaultSelfMetricsInterval); interval > 0 {
+		atlasMetrics = append(atlasMetrics, stats.selfMetrics(time.Now(), interval)...)
+	}
+
+	client := NewAtlasClientWithOptions(uri, commonTags, options)
+	if agg != nil {
+		agg.setClient(client)
+	}
+	if getBool(config, "async", false) {
+		err = f.publishAsync(uri, client, compiled.sender, atlasMetrics)
+	} else {
+		err = client.Publish(atlasMetrics)
+	}
+	if options.Compress {
+		logger.Debugf("Compression has saved %d of %d bytes sent to %s",
+			options.Stats.BytesSaved(), options.Stats.PayloadBytes(), uri)
+	}
+	return err
+}
+
+// Queue the metrics to be sent by the background sender for the URI. Since
+// the send happens later, the error returned will be for datapoints dropped
+// because the queue was full or for the most recent failed send since the
+// previous call.
+func (f *atlasPublisher) publishAsync(uri string, client AtlasClient, options senderOptions, metrics []Metric) error {
+	sender := f.getSender(uri, client, options)
+	sender.enqueue(metrics)
+
+	dropped, err := sender.status()
+	f.getStats(uri).recordDropped(dropQueueFull, dropped)
+	if dropped > 0 {
+		msg := fmt.Sprintf("dropped %d datapoints for %s because the queue is full", dropped, uri)
+		if err != nil {
+			msg = fmt.Sprintf("%s, previous send failed: %v", msg, err)
+		}
+		return errors.New(msg)
+	}
+	return err
 }
 
 func Meta() *plugin.PluginMeta {
-	return plugin.NewPluginMeta(name, version, pluginType, []string{plugin.SnapGOBContentType}, []string{plugin.SnapGOBContentType})
+	contentTypes := []string{plugin.SnapGOBContentType, plugin.SnapJSONContentType}
+	return plugin.NewPluginMeta(name, version, pluginType, contentTypes, contentTypes)
 }
 
 func (f *atlasPublisher) GetConfigPolicy() (*cpolicy.ConfigPolicy, error) {
@@ -305,11 +783,237 @@ func (f *atlasPublisher) GetConfigPolicy() (*cpolicy.ConfigPolicy, error) {
 
 	r2, err := cpolicy.NewStringRule("exclude", false)
 	handleErr(err)
-	r2.Description = "Regex on the namespace to exclude certain metrics."
+	r2.Description = "Patterns for metrics to exclude. Either a single pattern or a JSON array of patterns. " +
+		"A pattern is a regex on the namespace or of the form tag:<key>=~<regex> to match the value of a tag."
+
+	retry := DefaultRetryPolicy()
+
+	r3, err := cpolicy.NewIntegerRule("retry_max_attempts", false, retry.MaxAttempts)
+	handleErr(err)
+	r3.Description = "Maximum number of attempts for a POST to Atlas. Use 1 to disable retries."
+
+	r4, err := cpolicy.NewIntegerRule("retry_initial_backoff_ms", false, int(retry.InitialBackoff / time.Millisecond))
+	handleErr(err)
+	r4.Description = "Delay in milliseconds before the first retry, doubled for each subsequent retry."
+
+	r5, err := cpolicy.NewIntegerRule("retry_max_backoff_ms", false, int(retry.MaxBackoff / time.Millisecond))
+	handleErr(err)
+	r5.Description = "Maximum delay in milliseconds between retries, including delays requested with Retry-After."
+
+	r6, err := cpolicy.NewFloatRule("retry_jitter", false, retry.Jitter)
+	handleErr(err)
+	r6.Description = "Fraction of the retry delay, between 0.0 and 1.0, that is randomized."
+
+	httpOptions := DefaultHTTPOptions()
+
+	r7, err := cpolicy.NewIntegerRule("connect_timeout_ms", false, int(httpOptions.ConnectTimeout / time.Millisecond))
+	handleErr(err)
+	r7.Description = "Timeout in milliseconds for establishing a connection to Atlas. Must be positive."
+
+	r8, err := cpolicy.NewIntegerRule("request_timeout_ms", false, int(httpOptions.RequestTimeout / time.Millisecond))
+	handleErr(err)
+	r8.Description = "Timeout in milliseconds for a single POST request to Atlas including reading the response. " +
+		"Must be positive."
+
+	r9, err := cpolicy.NewIntegerRule("max_idle_conns", false, httpOptions.MaxIdleConns)
+	handleErr(err)
+	r9.Description = "Maximum number of idle connections to keep open to the Atlas server."
+
+	r10, err := cpolicy.NewIntegerRule("keep_alive_ms", false, int(httpOptions.KeepAlive / time.Millisecond))
+	handleErr(err)
+	r10.Description = "Interval in milliseconds for TCP keep-alive probes on connections to Atlas. Use 0 to " +
+		"disable the probes. Connections are still reused, see disable_connection_reuse."
+
+	r11, err := cpolicy.NewStringRule("tags", false)
+	handleErr(err)
+	r11.Description = "Common tags to add to all metrics in the form k1=v1,k2=v2. " +
+		"Tags can also be set individually using keys of the form tag.<key>. " +
+		"Values can refer to environment variables, e.g. {NETFLIX_APP}."
+
+	r12, err := cpolicy.NewBoolRule("compress", false, false)
+	handleErr(err)
+	r12.Description = "If true, then the payloads sent to Atlas will be compressed using gzip."
+
+	r13, err := cpolicy.NewIntegerRule("compression_level", false, gzip.DefaultCompression)
+	handleErr(err)
+	r13.Description = "Gzip compression level from 1 (fastest) to 9 (best compression), or -1 for the default."
+
+	sender := defaultSenderOptions()
+
+	r14, err := cpolicy.NewBoolRule("async", false, false)
+	handleErr(err)
+	r14.Description = "If true, then metrics are queued and sent to Atlas from a background goroutine."
+
+	r15, err := cpolicy.NewIntegerRule("queue_size", false, sender.QueueSize)
+	handleErr(err)
+	r15.Description = "Maximum number of datapoints to buffer when async is enabled."
+
+	r16, err := cpolicy.NewIntegerRule("flush_interval_ms", false, int(sender.FlushInterval / time.Millisecond))
+	handleErr(err)
+	r16.Description = "Interval in milliseconds for sending buffered datapoints when async is enabled."
+
+	r17, err := cpolicy.NewIntegerRule("flush_size", false, sender.FlushSize)
+	handleErr(err)
+	r17.Description = "Number of buffered datapoints that will trigger a send before the flush interval."
+
+	r18, err := cpolicy.NewStringRule("drop_policy", false, "drop-oldest")
+	handleErr(err)
+	r18.Description = "What to do when the queue is full: drop-oldest, drop-newest, or block."
+
+	spool := DefaultSpoolOptions()
+
+	r19, err := cpolicy.NewStringRule("spool_dir", false)
+	handleErr(err)
+	r19.Description = "Directory for persisting batches that fail to send so they can be replayed later. " +
+		"Spooling is disabled if not set."
+
+	r20, err := cpolicy.NewIntegerRule("spool_max_bytes", false, int(spool.MaxBytes))
+	handleErr(err)
+	r20.Description = "Maximum size in bytes of the spool. The oldest data is discarded if exceeded."
+
+	r21, err := cpolicy.NewIntegerRule("spool_max_age_ms", false, int(spool.MaxAge / time.Millisecond))
+	handleErr(err)
+	r21.Description = "Maximum age in milliseconds of spooled data. Older data is discarded without being sent."
+
+	r22, err := cpolicy.NewIntegerRule("spool_segment_bytes", false, int(spool.SegmentBytes))
+	handleErr(err)
+	r22.Description = "Size in bytes at which a new spool segment file is started."
+
+	r23, err := cpolicy.NewStringRule("counter_pattern", false)
+	handleErr(err)
+	r23.Description = "Regex on the namespace for metrics that are monotonically increasing counters. " +
+		"Counters, including metrics with a tag of type=counter, are converted to a per-second rate. " +
+		"For distributions that are counters, the count, total, and percentile series are converted."
+
+	r24, err := cpolicy.NewStringRule("dstype_rules", false)
+	handleErr(err)
+	r24.Description = "JSON array of rules for setting the atlas.dstype tag based on the namespace, " +
+		"e.g. [{\"pattern\": \"/bytes_.*$\", \"dstype\": \"sum\"}]. The first matching rule is used."
+
+	r25, err := cpolicy.NewStringRule("dstype_default", false, "gauge")
+	handleErr(err)
+	r25.Description = "The atlas.dstype for metrics that do not match a rule: gauge, rate, or sum."
+
+	r26, err := cpolicy.NewIntegerRule("step_ms", false, 0)
+	handleErr(err)
+	r26.Description = "Step size in milliseconds used by Atlas. If set, datapoints for each series are " +
+		"aggregated to a single value per step and only completed steps are sent. Use 0 to disable."
+
+	r27, err := cpolicy.NewStringRule("aggregation_rules", false)
+	handleErr(err)
+	r27.Description = "JSON array of rules for the statistic used when aggregating, based on the name tag, " +
+		"e.g. [{\"pattern\": \"^cpu\", \"stat\": \"max\"}]. Supported stats are max, sum, avg, and last. " +
+		"By default rates are averaged, sums are added, and the last value is used for gauges."
+
+	r28, err := cpolicy.NewStringRule("include", false)
+	handleErr(err)
+	r28.Description = "Patterns for metrics to include, using the same format as exclude. If set, only " +
+		"metrics matching at least one pattern are sent. Exclude patterns take precedence."
+
+	r29, err := cpolicy.NewStringRule("tag_rules", false)
+	handleErr(err)
+	r29.Description = "JSON array of rules applied in order to rewrite the tags of each metric. Supported " +
+		"actions are rename (source, target), drop (pattern on the key), add (target, value), and " +
+		"replace (source, pattern, replacement, optional target)."
+
+	r30, err := cpolicy.NewStringRule("ignore_tags", false, "unit,plugin_running_on")
+	handleErr(err)
+	r30.Description = "Comma separated list of snap tag keys that will not be sent to Atlas."
+
+	r31, err := cpolicy.NewStringRule("tag_mapping", false)
+	handleErr(err)
+	r31.Description = "Snap tag keys to rename when sent to Atlas in the form old1=new1,old2=new2, " +
+		"e.g. plugin_running_on=nf.node. Mapped tags are sent even if listed in ignore_tags."
+
+	r32, err := cpolicy.NewStringRule("name_rules", false)
+	handleErr(err)
+	r32.Description = "JSON array of rules for naming metrics, e.g. " +
+		"[{\"pattern\": \"^/intel/procfs/\", \"name\": \"{2}.{-1}\", \"tags\": {\"id\": \"{3}\"}}]. " +
+		"The first rule with a pattern matching the namespace is used. A name tag on the metric takes precedence."
+
+	r33, err := cpolicy.NewBoolRule("strict_templates", false, false)
+	handleErr(err)
+	r33.Description = "If true, then metrics with a tag or name template that refers to an unknown variable " +
+		"without a default are dropped. Otherwise, the unknown variable is left as is."
+
+	r34, err := cpolicy.NewStringRule("value_mapping", false)
+	handleErr(err)
+	r34.Description = "Numeric values to use for metrics with enum string values in the form " +
+		"k1=v1,k2=v2, e.g. up=1,down=0. Other strings are parsed as numbers and bools are sent as 0 or 1."
+
+	r35, err := cpolicy.NewStringRule("data_unit", false, "bytes")
+	handleErr(err)
+	r35.Description = "Base unit for metrics with a data unit such as KiB or Mb/s: bytes or bits."
+
+	r36, err := cpolicy.NewStringRule("unit_tag", false)
+	handleErr(err)
+	r36.Description = "Key for a tag with the normalized unit, e.g. bytes/second, for metrics with a known unit. " +
+		"If not set, then the unit is not sent to Atlas."
+
+	r37, err := cpolicy.NewIntegerRule("batch_size", false, metricBatchSize)
+	handleErr(err)
+	r37.Description = "Maximum number of datapoints to send to Atlas in a single request."
+
+	r38, err := cpolicy.NewIntegerRule("batch_max_bytes", false, defaultBatchBytes)
+	handleErr(err)
+	r38.Description = "Maximum size in bytes of the json payload for a single request before compression. " +
+		"Use 0 to only limit requests by the number of datapoints."
+
+	r39, err := cpolicy.NewIntegerRule("max_concurrency", false, 1)
+	handleErr(err)
+	r39.Description = "Maximum number of concurrent requests to Atlas for a URI. " +
+		"If greater than 1, then batches may arrive out of order. If tasks publishing to the same URI " +
+		"use different values, then the largest is used."
+
+	r40, err := cpolicy.NewIntegerRule("self_metrics_interval_ms", false, int(defaultSelfMetricsInterval / time.Millisecond))
+	handleErr(err)
+	r40.Description = "Interval in milliseconds for sending metrics about the publisher itself tagged with " +
+		"id=atlas-publisher, e.g. 60000. Disabled if 0."
+
+	validation := DefaultValidationOptions()
+
+	r41, err := cpolicy.NewBoolRule("validate", false, true)
+	handleErr(err)
+	r41.Description = "If true, then datapoints are checked against the Atlas publish rules before they are sent."
+
+	r42, err := cpolicy.NewIntegerRule("max_user_tags", false, validation.MaxUserTags)
+	handleErr(err)
+	r42.Description = "Maximum number of user tags for a datapoint including common tags. " +
+		"The name and tags with a prefix of nf. or atlas. are not counted."
+
+	r43, err := cpolicy.NewIntegerRule("max_key_length", false, validation.MaxKeyLength)
+	handleErr(err)
+	r43.Description = "Maximum length of a tag key."
+
+	r44, err := cpolicy.NewIntegerRule("max_value_length", false, validation.MaxValueLength)
+	handleErr(err)
+	r44.Description = "Maximum length of a tag value."
+
+	r45, err := cpolicy.NewIntegerRule("max_age_ms", false, 0)
+	handleErr(err)
+	r45.Description = "Maximum age in milliseconds of a datapoint when it is sent. Use 0 to disable the check."
+
+	r46, err := cpolicy.NewIntegerRule("max_future_ms", false, 0)
+	handleErr(err)
+	r46.Description = "Maximum amount of time in milliseconds that a datapoint can be in the future. " +
+		"Use 0 to disable the check."
+
+	r47, err := cpolicy.NewStringRule("invalid_action", false, "drop")
+	handleErr(err)
+	r47.Description = "Action for datapoints that fail validation, either drop or fix. If fix, then extra tags " +
+		"and reserved keys are removed and long keys and values are truncated. Datapoints without a name or " +
+		"outside the time limits are always dropped."
+
+	r48, err := cpolicy.NewBoolRule("disable_connection_reuse", false, httpOptions.DisableConnectionReuse)
+	handleErr(err)
+	r48.Description = "If true, then a new connection to Atlas is used for each request instead of reusing " +
+		"idle connections."
 
 	cp := cpolicy.New()
 	config := cpolicy.NewPolicyNode()
-	config.Add(r1, r2)
+	config.Add(r1, r2, r3, r4, r5, r6, r7, r8, r9, r10, r11, r12, r13, r14, r15, r16, r17, r18,
+		r19, r20, r21, r22, r23, r24, r25, r26, r27, r28, r29, r30, r31, r32, r33, r34, r35, r36, r37, r38, r39, r40,
+		r41, r42, r43, r44, r45, r46, r47, r48)
 	cp.Add([]string{""}, config)
 	return cp, nil
 }
@@ -16,13 +16,19 @@
 package atlas
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"math"
-	"regexp"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/intelsdi-x/snap/control/plugin"
 	"github.com/intelsdi-x/snap/core"
+	"github.com/intelsdi-x/snap/core/ctypes"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -42,39 +48,39 @@ func TestAtlasPublisher(t *testing.T) {
 	})
 
 	Convey("createAtlasTags", t, func() {
-		actual := createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{})
+		actual, _ := createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{}, nil)
 		expected := map[string]string{
 			"name": "test.foo",
 		}
 		So(actual, ShouldResemble, expected)
 
 		// ignore plugin_running_on
-		actual = createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{
+		actual, _ = createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{
 			"plugin_running_on": "foo",
-		})
+		}, nil)
 		So(actual, ShouldResemble, expected)
 
 		// ignore unit
-		actual = createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{
+		actual, _ = createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{
 			"unit": "foo",
-		})
+		}, nil)
 		So(actual, ShouldResemble, expected)
 
 		// name override
-		actual = createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{
+		actual, _ = createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{
 			"name": "custom.name",
-		})
+		}, nil)
 		expected = map[string]string{
 			"name": "custom.name",
 		}
 		So(actual, ShouldResemble, expected)
 
 		// other tags
-		actual = createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{
+		actual, _ = createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{
 			"name": "custom.name",
 			"nf.region": "us-east-1",
 			"nf.app": "my_app",
-		})
+		}, nil)
 		expected = map[string]string{
 			"name": "custom.name",
 			"nf.region": "us-east-1",
@@ -83,18 +89,18 @@ func TestAtlasPublisher(t *testing.T) {
 		So(actual, ShouldResemble, expected)
 
 		// positional vars
-		actual = createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{
+		actual, _ = createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{
 			"name": "{1}.{0}",
-		})
+		}, nil)
 		expected = map[string]string{
 			"name": "foo.test",
 		}
 		So(actual, ShouldResemble, expected)
 
 		// positional vars, from end of namespace
-		actual = createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{
+		actual, _ = createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{
 			"name": "{-1}.{-2}",
-		})
+		}, nil)
 		expected = map[string]string{
 			"name": "foo.test",
 		}
@@ -105,11 +111,11 @@ func TestAtlasPublisher(t *testing.T) {
 			AddDynamicElement("host", "desc").
 			AddStaticElement("foo")
 		dynNamespace[1].Value = "i-12345"
-		actual = createAtlasTags(dynNamespace, map[string]string{
+		actual, _ = createAtlasTags(dynNamespace, map[string]string{
 		  "name": "{namespace_static}",
 		  "fqdn": "{namespace}",
 		  "node": "{host}",
-		})
+		}, nil)
 		expected = map[string]string{
 			"name": "test.foo",
 			"fqdn": "test.i-12345.foo",
@@ -118,33 +124,97 @@ func TestAtlasPublisher(t *testing.T) {
 		So(actual, ShouldResemble, expected)
 	})
 
-	Convey("convertToBaseUnit", t, func() {
-		So(convertToBaseUnit("none", 1e10), ShouldResemble, 1e10)
+	Convey("createAtlasTags with dstype", t, func() {
+		dstypes, _ := parseDstypeRules(`[{"pattern": "/foo$", "dstype": "sum"}]`, "gauge")
+		options := &tagOptions{ignored: ignoredTags, dstypes: dstypes}
+
+		actual, _ := createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{}, options)
+		So(actual, ShouldResemble, map[string]string{"name": "test.foo", "atlas.dstype": "sum"})
+
+		actual, _ = createAtlasTags(core.NewNamespace("test", "bar"), map[string]string{}, options)
+		So(actual, ShouldResemble, map[string]string{"name": "test.bar", "atlas.dstype": "gauge"})
+
+		// explicit dstype tag is not changed
+		actual, _ = createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{
+			"atlas.dstype": "rate",
+		}, options)
+		So(actual, ShouldResemble, map[string]string{"name": "test.foo", "atlas.dstype": "rate"})
+	})
+
+	Convey("createAtlasTags with ignored and mapped tags", t, func() {
+		options := &tagOptions{
+			ignored: map[string]bool{"unit": true},
+			mapping: map[string]string{"plugin_running_on": "nf.node", "host": "name"},
+		}
+
+		actual, _ := createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{
+			"plugin_running_on": "i-12345",
+			"unit":              "B",
+			"source":            "{1}",
+		}, options)
+		So(actual, ShouldResemble, map[string]string{
+			"name":    "test.foo",
+			"nf.node": "i-12345",
+			"source":  "foo",
+		})
 
-		So(convertToBaseUnit("ns", 1e10), ShouldResemble, 10.0)
-		So(convertToBaseUnit("us", 1e10), ShouldResemble, 1e4)
-		So(convertToBaseUnit("ms", 1e10), ShouldResemble, 1e7)
+		// mapping to a key that is explicitly set on the metric
+		actual, _ = createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{
+			"plugin_running_on": "i-12345",
+			"nf.node":           "i-67890",
+			"host":              "{0}",
+		}, options)
+		So(actual, ShouldResemble, map[string]string{
+			"name":    "test",
+			"nf.node": "i-67890",
+		})
 
-		So(convertToBaseUnit("k", 1e10), ShouldResemble, 1e13)
-		So(convertToBaseUnit("M", 1e10), ShouldResemble, 1e16)
-		So(convertToBaseUnit("G", 1e10), ShouldResemble, 1e19)
-		So(convertToBaseUnit("T", 1e10), ShouldResemble, 1e22)
-		So(convertToBaseUnit("P", 1e10), ShouldResemble, 1e25)
-		So(convertToBaseUnit("E", 1e10), ShouldResemble, 1e28)
-		So(convertToBaseUnit("Z", 1e10), ShouldResemble, 1e31)
-		So(convertToBaseUnit("Y", 1e10), ShouldResemble, 1e34)
+		// ignored tags are still mapped
+		options.ignored["plugin_running_on"] = true
+		actual, _ = createAtlasTags(core.NewNamespace("test", "foo"), map[string]string{
+			"plugin_running_on": "i-12345",
+		}, options)
+		So(actual, ShouldResemble, map[string]string{
+			"name":    "test.foo",
+			"nf.node": "i-12345",
+		})
+	})
 
-		So(convertToBaseUnit("Ki", 1), ShouldResemble, 1024.0)
-		So(convertToBaseUnit("Mi", 1), ShouldResemble, 1024.0 * 1024.0)
-		So(convertToBaseUnit("Gi", 1), ShouldResemble, 1024.0 * 1024.0 * 1024.0)
-		So(convertToBaseUnit("Ti", 1), ShouldResemble, math.Pow(1024.0, 4))
-		So(convertToBaseUnit("Pi", 1), ShouldResemble, math.Pow(1024.0, 5))
-		So(convertToBaseUnit("Ei", 1), ShouldResemble, math.Pow(1024.0, 6))
-		So(convertToBaseUnit("Zi", 1), ShouldResemble, math.Pow(1024.0, 7))
-		So(convertToBaseUnit("Yi", 1), ShouldResemble, math.Pow(1024.0, 8))
+	Convey("parseUnit converts to the base unit", t, func() {
+		toBase := func(s string, value float64) float64 {
+			u, ok := parseUnit(s, false)
+			if !ok {
+				return value
+			}
+			return u.convert(value)
+		}
+
+		So(toBase("none", 1e10), ShouldResemble, 1e10)
+
+		So(toBase("ns", 1e10), ShouldResemble, 10.0)
+		So(toBase("us", 1e10), ShouldResemble, 1e4)
+		So(toBase("ms", 1e10), ShouldResemble, 1e7)
+
+		So(toBase("k", 1e10), ShouldResemble, 1e13)
+		So(toBase("M", 1e10), ShouldResemble, 1e16)
+		So(toBase("G", 1e10), ShouldResemble, 1e19)
+		So(toBase("T", 1e10), ShouldResemble, 1e22)
+		So(toBase("P", 1e10), ShouldResemble, 1e25)
+		So(toBase("E", 1e10), ShouldResemble, 1e28)
+		So(toBase("Z", 1e10), ShouldResemble, 1e31)
+		So(toBase("Y", 1e10), ShouldResemble, 1e34)
+
+		So(toBase("Ki", 1), ShouldResemble, 1024.0)
+		So(toBase("Mi", 1), ShouldResemble, 1024.0 * 1024.0)
+		So(toBase("Gi", 1), ShouldResemble, 1024.0 * 1024.0 * 1024.0)
+		So(toBase("Ti", 1), ShouldResemble, math.Pow(1024.0, 4))
+		So(toBase("Pi", 1), ShouldResemble, math.Pow(1024.0, 5))
+		So(toBase("Ei", 1), ShouldResemble, math.Pow(1024.0, 6))
+		So(toBase("Zi", 1), ShouldResemble, math.Pow(1024.0, 7))
+		So(toBase("Yi", 1), ShouldResemble, math.Pow(1024.0, 8))
 	})
 
-	Convey("filterNot", t, func() {
+	Convey("filterMetrics", t, func() {
 		timestamp := time.Now()
 		input := []plugin.MetricType{
 			*plugin.NewMetricType(core.NewNamespace("foo"), timestamp, nil, "", 99),
@@ -152,19 +222,19 @@ func TestAtlasPublisher(t *testing.T) {
 			*plugin.NewMetricType(core.NewNamespace("foo", "bar", "baz"), timestamp, nil, "", 99),
 		}
 
-		So(filterNot(input, nil), ShouldResemble, input)
+		So(filterMetrics(input, nil), ShouldResemble, input)
 
-		exclude, _ := regexp.Compile("/foo/bar.*")
-		So(filterNot(input, exclude), ShouldResemble, input[:1])
+		exclude, _ := parseMatcher("/foo/bar.*")
+		So(filterMetrics(input, &metricFilter{exclude: []*matcher{exclude}}), ShouldResemble, input[:1])
 
-		exclude, _ = regexp.Compile("/foo/.*")
-		So(filterNot(input, exclude), ShouldResemble, input[:1])
+		exclude, _ = parseMatcher("/foo/.*")
+		So(filterMetrics(input, &metricFilter{exclude: []*matcher{exclude}}), ShouldResemble, input[:1])
 
-		exclude, _ = regexp.Compile("^(/foo|/foo/bar/baz)$")
-		So(filterNot(input, exclude), ShouldResemble, input[1:2])
+		exclude, _ = parseMatcher("^(/foo|/foo/bar/baz)$")
+		So(filterMetrics(input, &metricFilter{exclude: []*matcher{exclude}}), ShouldResemble, input[1:2])
 
-		exclude, _ = regexp.Compile("/foo.*")
-		So(filterNot(input, exclude), ShouldResemble, []plugin.MetricType{})
+		exclude, _ = parseMatcher("/foo.*")
+		So(filterMetrics(input, &metricFilter{exclude: []*matcher{exclude}}), ShouldResemble, []plugin.MetricType{})
 	})
 
 	Convey("toAtlasMetric", t, func() {
@@ -179,7 +249,9 @@ func TestAtlasPublisher(t *testing.T) {
 			99.0,
 		}
 
-		So(*toAtlasMetric(input), ShouldResemble, expected)
+		actual, err := toAtlasMetric(input, nil, nil)
+		So(err, ShouldBeNil)
+		So(*actual, ShouldResemble, expected)
 	})
 
 	Convey("toAtlasMetric unit conversion", t, func() {
@@ -201,13 +273,66 @@ func TestAtlasPublisher(t *testing.T) {
 			99.0 * 1024.0,
 		}
 
-		So(*toAtlasMetric(input), ShouldResemble, expected)
+		actual, err := toAtlasMetric(input, nil, nil)
+		So(err, ShouldBeNil)
+		So(*actual, ShouldResemble, expected)
 	})
 
 	Convey("toAtlasMetric non-numeric", t, func() {
 		timestamp := time.Now()
-		input := *plugin.NewMetricType(core.NewNamespace("foo"), timestamp, nil, "", "99")
-		So(toAtlasMetric(input), ShouldEqual, nil)
+		input := *plugin.NewMetricType(core.NewNamespace("foo"), timestamp, nil, "", "foo")
+		actual, err := toAtlasMetric(input, nil, nil)
+		So(actual, ShouldEqual, nil)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("toNumber", t, func() {
+		for _, v := range []interface{}{int8(42), uint16(42), int64(42), uint64(42), float32(42.0), 42.0, "42", " 42.0 ", "4.2e1"} {
+			n, err := toNumber(v, nil)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 42.0)
+		}
+
+		n, err := toNumber(true, nil)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1.0)
+		n, err = toNumber(false, nil)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 0.0)
+
+		mapping := map[string]float64{"up": 1.0, "down": 0.0, "42": 1.0}
+		n, err = toNumber("up", mapping)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1.0)
+		n, err = toNumber("down", mapping)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 0.0)
+		n, err = toNumber("42", mapping)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1.0)
+
+		for _, v := range []interface{}{"unknown", "", []int{1}, nil} {
+			_, err = toNumber(v, mapping)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("toAtlasMetrics counts non-numeric values", t, func() {
+		timestamp := time.Unix(1, 0)
+		input := []plugin.MetricType{
+			*plugin.NewMetricType(core.NewNamespace("foo"), timestamp, nil, "", "up"),
+			*plugin.NewMetricType(core.NewNamespace("foo"), timestamp, nil, "", "unknown"),
+			*plugin.NewMetricType(core.NewNamespace("bar"), timestamp, nil, "", true),
+			*plugin.NewMetricType(core.NewNamespace("bar"), timestamp, nil, "", struct{}{}),
+			*plugin.NewMetricType(core.NewNamespace("bar"), timestamp, nil, "", "unknown"),
+		}
+
+		conv := &converter{values: &valueOptions{mapping: map[string]float64{"up": 1.0}}}
+		So(conv.toAtlasMetrics(input), ShouldResemble, []Metric{
+			Metric{map[string]string{"name": "foo"}, 1000, 1.0},
+			Metric{map[string]string{"name": "bar"}, 1000, 1.0},
+		})
+		So(conv.dropped, ShouldResemble, map[string]int{"/foo": 1, "/bar": 2})
 	})
 
 	Convey("toAtlasMetrics", t, func() {
@@ -227,6 +352,382 @@ func TestAtlasPublisher(t *testing.T) {
 			},
 		}
 
-		So(toAtlasMetrics(input), ShouldResemble, expected)
+		conv := &converter{}
+		So(conv.toAtlasMetrics(input), ShouldResemble, expected)
+	})
+
+	Convey("Publish with common tags", t, func() {
+		var payload map[string]interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&payload)
+		}))
+		defer server.Close()
+
+		timestamp := time.Now()
+		content, _, err := plugin.MarshalMetricTypes(plugin.SnapGOBContentType, []plugin.MetricType{
+			*plugin.NewMetricType(core.NewNamespace("foo"), timestamp, nil, "", 99),
+		})
+		So(err, ShouldBeNil)
+
+		os.Setenv("ATLAS_TEST_APP", "foo")
+		defer os.Unsetenv("ATLAS_TEST_APP")
+
+		publisher := NewAtlasPublisher()
+		err = publisher.Publish(plugin.SnapGOBContentType, content, map[string]ctypes.ConfigValue{
+			"uri":         ctypes.ConfigValueStr{Value: server.URL},
+			"tags":        ctypes.ConfigValueStr{Value: "nf.app={ATLAS_TEST_APP},nf.node=i-1"},
+			"tag.nf.zone": ctypes.ConfigValueStr{Value: "us-east-1e"},
+		})
+		So(err, ShouldBeNil)
+		So(payload["tags"], ShouldResemble, map[string]interface{}{
+			"nf.app":  "foo",
+			"nf.node": "i-1",
+			"nf.zone": "us-east-1e",
+		})
+	})
+
+	Convey("Publish async", t, func() {
+		var payload map[string]interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&payload)
+		}))
+		defer server.Close()
+
+		content, _, err := plugin.MarshalMetricTypes(plugin.SnapGOBContentType, []plugin.MetricType{
+			*plugin.NewMetricType(core.NewNamespace("foo"), time.Now(), nil, "", 99),
+		})
+		So(err, ShouldBeNil)
+
+		publisher := NewAtlasPublisher()
+		err = publisher.Publish(plugin.SnapGOBContentType, content, map[string]ctypes.ConfigValue{
+			"uri":               ctypes.ConfigValueStr{Value: server.URL},
+			"async":             ctypes.ConfigValueBool{Value: true},
+			"flush_interval_ms": ctypes.ConfigValueInt{Value: 3600000},
+		})
+		So(err, ShouldBeNil)
+		So(payload, ShouldBeNil)
+
+		// Queued metrics should get sent when the publisher is closed
+		So(publisher.Close(), ShouldBeNil)
+		So(len(payload["metrics"].([]interface{})), ShouldEqual, 1)
+	})
+
+	Convey("Publish with self-metrics", t, func() {
+		var payload metricBatch
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			payload = metricBatch{}
+			json.NewDecoder(r.Body).Decode(&payload)
+		}))
+		defer server.Close()
+
+		content, _, err := plugin.MarshalMetricTypes(plugin.SnapGOBContentType, []plugin.MetricType{
+			*plugin.NewMetricType(core.NewNamespace("foo"), time.Now(), nil, "", 99),
+			*plugin.NewMetricType(core.NewNamespace("bar"), time.Now(), nil, "", "up"),
+		})
+		So(err, ShouldBeNil)
+
+		config := map[string]ctypes.ConfigValue{
+			"uri":                      ctypes.ConfigValueStr{Value: server.URL},
+			"self_metrics_interval_ms": ctypes.ConfigValueInt{Value: 1},
+		}
+		publisher := NewAtlasPublisher()
+		So(publisher.Publish(plugin.SnapGOBContentType, content, config), ShouldBeNil)
+		So(len(payload.Metrics), ShouldEqual, 1)
+
+		time.Sleep(5 * time.Millisecond)
+		So(publisher.Publish(plugin.SnapGOBContentType, content, config), ShouldBeNil)
+		self := map[string]float64{}
+		for _, m := range payload.Metrics {
+			if m.Tags["id"] == "atlas-publisher" {
+				self[tagsKey(m.Tags)] = m.Value
+			}
+		}
+		So(len(self), ShouldBeGreaterThan, 0)
+		So(self, ShouldContainKey, "atlas.dstype=rate,id=atlas-publisher,name=atlas.publisher.dropped,reason=nonNumeric,")
+		So(self, ShouldContainKey, "atlas.dstype=rate,id=atlas-publisher,name=atlas.publisher.requests,statusCode=200,")
+
+		// Self-metrics are disabled by default
+		config = map[string]ctypes.ConfigValue{"uri": ctypes.ConfigValueStr{Value: server.URL}}
+		publisher = NewAtlasPublisher()
+		for i := 0; i < 2; i++ {
+			So(publisher.Publish(plugin.SnapGOBContentType, content, config), ShouldBeNil)
+			So(len(payload.Metrics), ShouldEqual, 1)
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+
+	Convey("Publish without the spool if it cannot be opened", t, func() {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+		}))
+		defer server.Close()
+
+		// Spool directory cannot be created because the parent is a file
+		file, err := ioutil.TempFile("", "atlas-spool")
+		So(err, ShouldBeNil)
+		file.Close()
+		defer os.Remove(file.Name())
+
+		content, _, err := plugin.MarshalMetricTypes(plugin.SnapGOBContentType, []plugin.MetricType{
+			*plugin.NewMetricType(core.NewNamespace("foo"), time.Now(), nil, "", 99),
+		})
+		So(err, ShouldBeNil)
+
+		config := map[string]ctypes.ConfigValue{
+			"uri":       ctypes.ConfigValueStr{Value: server.URL},
+			"spool_dir": ctypes.ConfigValueStr{Value: file.Name()},
+		}
+		publisher := NewAtlasPublisher()
+		So(publisher.Publish(plugin.SnapGOBContentType, content, config), ShouldBeNil)
+		So(publisher.Publish(plugin.SnapGOBContentType, content, config), ShouldBeNil)
+		So(requests, ShouldEqual, 2)
+
+		// Open is not attempted again until the retry interval has passed
+		stats := publisher.getStats(server.URL)
+		id := statID{"atlas.publisher.spoolErrors", "operation", "open"}
+		So(stats.counters[id], ShouldEqual, 1.0)
+
+		e := publisher.spoolErrors[server.URL]
+		e.time = e.time.Add(-spoolRetryInterval)
+		publisher.spoolErrors[server.URL] = e
+		So(publisher.Publish(plugin.SnapGOBContentType, content, config), ShouldBeNil)
+		So(stats.counters[id], ShouldEqual, 2.0)
+		So(requests, ShouldEqual, 3)
+	})
+
+	Convey("Publish json content", t, func() {
+		var payload map[string]interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&payload)
+		}))
+		defer server.Close()
+
+		content, _, err := plugin.MarshalMetricTypes(plugin.SnapJSONContentType, []plugin.MetricType{
+			*plugin.NewMetricType(core.NewNamespace("foo", "bar"), time.Unix(1, 0), nil, "", 99),
+		})
+		So(err, ShouldBeNil)
+
+		publisher := NewAtlasPublisher()
+		err = publisher.Publish(plugin.SnapJSONContentType, content, map[string]ctypes.ConfigValue{
+			"uri": ctypes.ConfigValueStr{Value: server.URL},
+		})
+		So(err, ShouldBeNil)
+		So(payload["metrics"], ShouldResemble, []interface{}{
+			map[string]interface{}{
+				"tags":      map[string]interface{}{"name": "foo.bar", "atlas.dstype": "gauge"},
+				"timestamp": 1000.0,
+				"value":     99.0,
+			},
+		})
+
+		err = publisher.Publish(plugin.SnapJSONContentType, []byte("{"), map[string]ctypes.ConfigValue{
+			"uri": ctypes.ConfigValueStr{Value: server.URL},
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Publish with aggregation", t, func() {
+		var payload map[string]interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&payload)
+		}))
+		defer server.Close()
+
+		content, _, err := plugin.MarshalMetricTypes(plugin.SnapGOBContentType, []plugin.MetricType{
+			*plugin.NewMetricType(core.NewNamespace("foo"), time.Unix(60, 0), nil, "", 1),
+			*plugin.NewMetricType(core.NewNamespace("foo"), time.Unix(70, 0), nil, "", 5),
+			*plugin.NewMetricType(core.NewNamespace("foo"), time.Unix(80, 0), nil, "", 3),
+		})
+		So(err, ShouldBeNil)
+
+		publisher := NewAtlasPublisher()
+		err = publisher.Publish(plugin.SnapGOBContentType, content, map[string]ctypes.ConfigValue{
+			"uri":               ctypes.ConfigValueStr{Value: server.URL},
+			"step_ms":           ctypes.ConfigValueInt{Value: 60000},
+			"aggregation_rules": ctypes.ConfigValueStr{Value: `[{"pattern": "^foo$", "stat": "max"}]`},
+		})
+		So(err, ShouldBeNil)
+		So(payload["metrics"], ShouldResemble, []interface{}{
+			map[string]interface{}{
+				"tags":      map[string]interface{}{"name": "foo", "atlas.dstype": "gauge"},
+				"timestamp": 60000.0,
+				"value":     5.0,
+			},
+		})
+	})
+
+	Convey("Close sends steps in progress for each step", t, func() {
+		var mutex sync.Mutex
+		var received []Metric
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var batch metricBatch
+			json.NewDecoder(r.Body).Decode(&batch)
+			mutex.Lock()
+			received = append(received, batch.Metrics...)
+			mutex.Unlock()
+		}))
+		defer server.Close()
+
+		publisher := NewAtlasPublisher()
+		for _, step := range []int{3600000, 7200000} {
+			content, _, err := plugin.MarshalMetricTypes(plugin.SnapGOBContentType, []plugin.MetricType{
+				*plugin.NewMetricType(core.NewNamespace("foo"), time.Now(), nil, "", step),
+			})
+			So(err, ShouldBeNil)
+			err = publisher.Publish(plugin.SnapGOBContentType, content, map[string]ctypes.ConfigValue{
+				"uri":     ctypes.ConfigValueStr{Value: server.URL},
+				"step_ms": ctypes.ConfigValueInt{Value: step},
+			})
+			So(err, ShouldBeNil)
+		}
+
+		// Both steps are still in progress so nothing has been sent
+		So(received, ShouldBeEmpty)
+
+		So(publisher.Close(), ShouldBeNil)
+		values := map[float64]bool{}
+		for _, m := range received {
+			values[m.Value] = true
+		}
+		So(values, ShouldResemble, map[float64]bool{3600000.0: true, 7200000.0: true})
+	})
+
+	Convey("Close sends steps in progress with the tags for each task", t, func() {
+		var mutex sync.Mutex
+		received := map[string][]Metric{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var batch metricBatch
+			json.NewDecoder(r.Body).Decode(&batch)
+			mutex.Lock()
+			received[batch.Tags["nf.app"]] = append(received[batch.Tags["nf.app"]], batch.Metrics...)
+			mutex.Unlock()
+		}))
+		defer server.Close()
+
+		publisher := NewAtlasPublisher()
+		for _, app := range []string{"foo", "bar"} {
+			content, _, err := plugin.MarshalMetricTypes(plugin.SnapGOBContentType, []plugin.MetricType{
+				*plugin.NewMetricType(core.NewNamespace(app), time.Now(), nil, "", 1),
+			})
+			So(err, ShouldBeNil)
+			err = publisher.Publish(plugin.SnapGOBContentType, content, map[string]ctypes.ConfigValue{
+				"uri":     ctypes.ConfigValueStr{Value: server.URL},
+				"step_ms": ctypes.ConfigValueInt{Value: 3600000},
+				"tags":    ctypes.ConfigValueStr{Value: "nf.app=" + app},
+			})
+			So(err, ShouldBeNil)
+		}
+		So(len(publisher.aggregators), ShouldEqual, 2)
+
+		So(publisher.Close(), ShouldBeNil)
+		So(len(received), ShouldEqual, 2)
+		for _, app := range []string{"foo", "bar"} {
+			So(len(received[app]), ShouldEqual, 1)
+			So(received[app][0].Tags["name"], ShouldEqual, app)
+		}
+	})
+
+	Convey("Publish with invalid exclude pattern", t, func() {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+		}))
+		defer server.Close()
+
+		content, _, err := plugin.MarshalMetricTypes(plugin.SnapGOBContentType, []plugin.MetricType{
+			*plugin.NewMetricType(core.NewNamespace("foo"), time.Now(), nil, "", 99),
+		})
+		So(err, ShouldBeNil)
+
+		publisher := NewAtlasPublisher()
+		err = publisher.Publish(plugin.SnapGOBContentType, content, map[string]ctypes.ConfigValue{
+			"uri":     ctypes.ConfigValueStr{Value: server.URL},
+			"exclude": ctypes.ConfigValueStr{Value: "/foo(bar"},
+		})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "/foo(bar")
+		So(requests, ShouldEqual, 0)
+		So(publisher.compiled, ShouldBeEmpty)
+
+		// Valid config is only compiled once
+		config := map[string]ctypes.ConfigValue{
+			"uri":     ctypes.ConfigValueStr{Value: server.URL},
+			"exclude": ctypes.ConfigValueStr{Value: "/bar"},
+		}
+		So(publisher.Publish(plugin.SnapGOBContentType, content, config), ShouldBeNil)
+		compiled, _ := publisher.getCompiledConfig(config)
+		So(publisher.Publish(plugin.SnapGOBContentType, content, config), ShouldBeNil)
+		So(len(publisher.compiled), ShouldEqual, 1)
+		cached, _ := publisher.getCompiledConfig(config)
+		So(cached, ShouldEqual, compiled)
+		So(requests, ShouldEqual, 2)
+	})
+
+	Convey("Publish with invalid client settings does not change state", t, func() {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+		}))
+		defer server.Close()
+
+		content, _, err := plugin.MarshalMetricTypes(plugin.SnapGOBContentType, []plugin.MetricType{
+			*plugin.NewMetricType(core.NewNamespace("foo", "bytes"), time.Now(), nil, "", 99),
+		})
+		So(err, ShouldBeNil)
+
+		publisher := NewAtlasPublisher()
+		for _, key := range []string{"batch_size", "max_concurrency", "spool_max_bytes", "queue_size"} {
+			err = publisher.Publish(plugin.SnapGOBContentType, content, map[string]ctypes.ConfigValue{
+				"uri":             ctypes.ConfigValueStr{Value: server.URL},
+				"counter_pattern": ctypes.ConfigValueStr{Value: "/bytes$"},
+				"step_ms":         ctypes.ConfigValueInt{Value: 60000},
+				key:               ctypes.ConfigValueInt{Value: 0},
+			})
+			So(err, ShouldNotBeNil)
+		}
+		So(requests, ShouldEqual, 0)
+		So(publisher.rates, ShouldBeEmpty)
+		So(publisher.aggregators, ShouldBeEmpty)
+	})
+
+	Convey("Publish shares the request limiter for a URI", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+
+		content, _, err := plugin.MarshalMetricTypes(plugin.SnapGOBContentType, []plugin.MetricType{
+			*plugin.NewMetricType(core.NewNamespace("foo"), time.Now(), nil, "", 99),
+		})
+		So(err, ShouldBeNil)
+
+		publisher := NewAtlasPublisher()
+		var limiters []*RequestLimiter
+		for _, n := range []int{2, 4, 1} {
+			err = publisher.Publish(plugin.SnapGOBContentType, content, map[string]ctypes.ConfigValue{
+				"uri":             ctypes.ConfigValueStr{Value: server.URL},
+				"max_concurrency": ctypes.ConfigValueInt{Value: n},
+			})
+			So(err, ShouldBeNil)
+			limiters = append(limiters, publisher.limiters[server.URL])
+		}
+
+		// Same limiter is used for all configs and has the largest size
+		So(len(publisher.limiters), ShouldEqual, 1)
+		So(limiters[1], ShouldPointTo, limiters[0])
+		So(limiters[2], ShouldPointTo, limiters[0])
+		So(limiters[0].Size(), ShouldEqual, 4)
+	})
+
+	Convey("Publish unknown content type", t, func() {
+		publisher := NewAtlasPublisher()
+		err := publisher.Publish("snap.foo", []byte{}, map[string]ctypes.ConfigValue{
+			"uri": ctypes.ConfigValueStr{Value: "http://localhost/api/v1/publish"},
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Meta", t, func() {
+		meta := Meta()
+		So(meta.AcceptedContentTypes, ShouldResemble, []string{plugin.SnapGOBContentType, plugin.SnapJSONContentType})
 	})
 }
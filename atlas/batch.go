@@ -0,0 +1,99 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Default maximum size of the encoded json payload for a batch. A value of 0
+// means that batches are only limited by the number of datapoints.
+const defaultBatchBytes = 0
+
+// Verify the batch limits are usable.
+func checkBatchLimits(size, bytes int) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid batch size %d, must be greater than 0", size)
+	}
+	if bytes < 0 {
+		return fmt.Errorf("invalid batch bytes %d, must be greater than or equal to 0", bytes)
+	}
+	return nil
+}
+
+// Breaks up a list of metrics into batches that are limited by the number of
+// datapoints and by the approximate size of the encoded json payload. The
+// metrics in the batches have sanitized tags.
+type batchIterator struct {
+	metrics  []Metric
+	pos      int
+	maxSize  int
+	maxBytes int
+
+	// Size of the encoded payload without any datapoints.
+	overhead int
+}
+
+func newBatchIterator(metrics []Metric, commonTags map[string]string, maxSize, maxBytes int) *batchIterator {
+	overhead := 0
+	if maxBytes > 0 {
+		if data, err := json.Marshal(metricBatch{commonTags, []Metric{}}); err == nil {
+			overhead = len(data)
+		}
+	}
+	return &batchIterator{metrics, 0, maxSize, maxBytes, overhead}
+}
+
+// Returns the encoded size of the metric including the separator. Values that
+// cannot be encoded, such as NaN, are filtered out before sending so they are
+// counted as 0.
+func encodedSize(m Metric) int {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return 0
+	}
+	return len(data) + 1
+}
+
+// Returns the next batch or false if all metrics have been consumed. A batch
+// will always have at least one datapoint even if that datapoint alone exceeds
+// the byte limit.
+func (it *batchIterator) next() ([]Metric, bool) {
+	if it.pos >= len(it.metrics) {
+		return nil, false
+	}
+
+	end := min(it.pos+it.maxSize, len(it.metrics))
+	batch := make([]Metric, 0, end-it.pos)
+	size := it.overhead
+	for i := it.pos; i < end; i++ {
+		m := Metric{
+			sanitizeMap(it.metrics[i].Tags),
+			it.metrics[i].Timestamp,
+			it.metrics[i].Value,
+		}
+		if it.maxBytes > 0 {
+			size += encodedSize(m)
+			if size > it.maxBytes && len(batch) > 0 {
+				break
+			}
+		}
+		batch = append(batch, m)
+	}
+	it.pos += len(batch)
+	return batch, true
+}
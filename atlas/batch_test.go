@@ -0,0 +1,159 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBatch(t *testing.T) {
+
+	newMetrics := func(n int) []Metric {
+		metrics := make([]Metric, n)
+		for i := range metrics {
+			metrics[i] = Metric{map[string]string{"name": fmt.Sprintf("m%d", i)}, 0, float64(i)}
+		}
+		return metrics
+	}
+
+	collect := func(it *batchIterator) [][]Metric {
+		var batches [][]Metric
+		for {
+			batch, ok := it.next()
+			if !ok {
+				return batches
+			}
+			batches = append(batches, batch)
+		}
+	}
+
+	Convey("checkBatchLimits", t, func() {
+		So(checkBatchLimits(1, 0), ShouldBeNil)
+		So(checkBatchLimits(metricBatchSize, 1024), ShouldBeNil)
+		So(checkBatchLimits(0, 0), ShouldNotBeNil)
+		So(checkBatchLimits(1, -1), ShouldNotBeNil)
+	})
+
+	Convey("empty input", t, func() {
+		So(collect(newBatchIterator(nil, nil, 10, 0)), ShouldBeEmpty)
+	})
+
+	Convey("batches limited by count", t, func() {
+		metrics := newMetrics(25)
+		batches := collect(newBatchIterator(metrics, nil, 10, 0))
+		So(len(batches), ShouldEqual, 3)
+		So(batches[0], ShouldResemble, metrics[0:10])
+		So(batches[1], ShouldResemble, metrics[10:20])
+		So(batches[2], ShouldResemble, metrics[20:25])
+	})
+
+	Convey("batches have sanitized tags", t, func() {
+		metrics := []Metric{Metric{map[string]string{"name": "foo bar"}, 0, 1.0}}
+		batches := collect(newBatchIterator(metrics, nil, 10, 0))
+		So(batches, ShouldResemble, [][]Metric{
+			[]Metric{Metric{map[string]string{"name": "foo_bar"}, 0, 1.0}},
+		})
+	})
+
+	Convey("batches limited by bytes", t, func() {
+		commonTags := map[string]string{"nf.app": "foo"}
+		metrics := newMetrics(100)
+		maxBytes := 512
+		batches := collect(newBatchIterator(metrics, commonTags, 50, maxBytes))
+		So(len(batches), ShouldBeGreaterThan, 2)
+
+		var all []Metric
+		for _, batch := range batches {
+			So(len(batch), ShouldBeLessThanOrEqualTo, 50)
+			data, _ := json.Marshal(metricBatch{commonTags, batch})
+			So(len(data), ShouldBeLessThanOrEqualTo, maxBytes)
+			all = append(all, batch...)
+		}
+		So(all, ShouldResemble, metrics)
+	})
+
+	Convey("datapoint larger than the byte limit is sent by itself", t, func() {
+		metrics := newMetrics(3)
+		batches := collect(newBatchIterator(metrics, nil, 10, 1))
+		So(len(batches), ShouldEqual, 3)
+		for i, batch := range batches {
+			So(batch, ShouldResemble, metrics[i:i+1])
+		}
+	})
+
+	Convey("values that cannot be encoded do not count towards the byte limit", t, func() {
+		metrics := []Metric{
+			Metric{map[string]string{"name": "a"}, 0, math.NaN()},
+			Metric{map[string]string{"name": "b"}, 0, math.Inf(1)},
+		}
+		batches := collect(newBatchIterator(metrics, nil, 10, 32))
+		So(len(batches), ShouldEqual, 1)
+		So(len(batches[0]), ShouldEqual, 2)
+	})
+
+	Convey("publish sends every datapoint exactly once", t, func() {
+		client := NewAtlasClient("/api/v1/publish", map[string]string{}).(httpAtlasClient)
+
+		n := 2*metricBatchSize + 123
+		metrics := newMetrics(n)
+
+		requests := 0
+		counts := map[string]int{}
+		f := func(data []byte) error {
+			requests++
+			var batch metricBatch
+			if err := json.Unmarshal(data, &batch); err != nil {
+				return err
+			}
+			for _, m := range batch.Metrics {
+				counts[m.Tags["name"]]++
+			}
+			return nil
+		}
+
+		_, err := client.publish(metrics, f)
+		So(err, ShouldBeNil)
+		So(requests, ShouldEqual, 3)
+		So(len(counts), ShouldEqual, n)
+		for _, m := range metrics {
+			So(counts[m.Tags["name"]], ShouldEqual, 1)
+		}
+	})
+
+	Convey("publish uses the configured batch limits", t, func() {
+		options := DefaultClientOptions()
+		options.BatchSize = 10
+		options.BatchBytes = 256
+		client := NewAtlasClientWithOptions("/api/v1/publish", map[string]string{}, options).(httpAtlasClient)
+
+		var sizes []int
+		f := func(data []byte) error {
+			sizes = append(sizes, len(data))
+			return nil
+		}
+		_, err := client.publish(newMetrics(100), f)
+		So(err, ShouldBeNil)
+		So(len(sizes), ShouldBeGreaterThan, 10)
+		for _, size := range sizes {
+			So(size, ShouldBeLessThanOrEqualTo, 256)
+		}
+	})
+}
@@ -17,17 +17,22 @@ package atlas
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
-// Maximum number of datapoints to send to Atlas per request.
+// Default maximum number of datapoints to send to Atlas per request.
 const metricBatchSize = 10000
 
 type Metric struct {
@@ -42,12 +47,200 @@ type metricBatch struct {
 }
 
 type AtlasClient interface {
-	Publish(metrics []Metric)
+	Publish(metrics []Metric) error
 }
 
+// Error returned from Publish if one or more of the batches could not be
+// sent to Atlas.
+type PublishError struct {
+	URI      string
+	Failures []BatchFailure
+}
+
+// Outcome for a single batch that failed to send.
+type BatchFailure struct {
+	// Index of the batch within the Publish call.
+	Batch int
+
+	// HTTP status code from the response or 0 if no response was received.
+	StatusCode int
+
+	// Body of the response, if any.
+	Body string
+
+	// Number of datapoints in the batch that were dropped.
+	Dropped int
+
+	// True if the batch was written to the spool to be sent later.
+	Spooled bool
+
+	// Details for the datapoints rejected by the server. Only set if the
+	// response included them.
+	Validation *ValidationResult
+
+	// Underlying error for the failure.
+	Err error
+}
+
+// Outcome for a call to Publish.
+type PublishResult struct {
+	// Batches that were accepted by the server, but where some of the
+	// datapoints were rejected because they failed validation. The dropped
+	// count is the number of rejected datapoints. Ordered by the batch index.
+	Partial []BatchFailure
+}
+
+// Total number of datapoints that were rejected by the server for batches
+// that were otherwise accepted.
+func (r *PublishResult) Rejected() int {
+	total := 0
+	for _, f := range r.Partial {
+		total += f.Dropped
+	}
+	return total
+}
+
+func (e *PublishError) Error() string {
+	msgs := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		if f.Spooled {
+			msgs[i] = fmt.Sprintf("batch %d: %v (spooled)", f.Batch, f.Err)
+		} else {
+			msgs[i] = fmt.Sprintf("batch %d: %v (%d datapoints dropped)", f.Batch, f.Err, f.Dropped)
+		}
+	}
+	return fmt.Sprintf("failed to publish %d of the batches to %s: %s",
+		len(e.Failures), e.URI, strings.Join(msgs, "; "))
+}
+
+// Total number of datapoints that were dropped across all failed batches.
+func (e *PublishError) Dropped() int {
+	total := 0
+	for _, f := range e.Failures {
+		total += f.Dropped
+	}
+	return total
+}
+
+// Error for a POST that resulted in a response with an unexpected status
+// code.
+type httpError struct {
+	StatusCode int
+	Body       string
+
+	// Delay requested by the server using the Retry-After header.
+	RetryAfter time.Duration
+}
+
+// Error for a batch that failed to send, but was written to the spool so it
+// can be replayed later.
+type spooledError struct {
+	Err error
+}
+
+func (e *spooledError) Error() string {
+	return fmt.Sprintf("%v (spooled)", e.Err)
+}
+
+func (e *httpError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("status code %d", e.StatusCode)
+	}
+	return fmt.Sprintf("status code %d: %s", e.StatusCode, e.Body)
+}
+
+// Create a batch failure entry based on the error returned when trying to
+// send the batch.
+func newBatchFailure(batch int, dropped int, err error) BatchFailure {
+	failure := BatchFailure{
+		Batch:   batch,
+		Dropped: dropped,
+		Err:     err,
+	}
+	if e, ok := err.(*spooledError); ok {
+		failure.Dropped = 0
+		failure.Spooled = true
+		failure.Err = e.Err
+		err = e.Err
+	}
+	if e, ok := err.(*httpError); ok {
+		failure.StatusCode = e.StatusCode
+		failure.Body = e.Body
+	}
+	if e, ok := err.(*rejectedError); ok {
+		failure.StatusCode = e.StatusCode
+		failure.Body = e.Body
+		failure.Validation = &e.Result
+	}
+	return failure
+}
+
+// Settings to control the behavior of the client.
+type ClientOptions struct {
+	// Policy used for retrying failed requests.
+	Retry RetryPolicy
+
+	// HTTP client used for sending requests. It should be long lived so
+	// that connections can be reused.
+	HTTPClient *http.Client
+
+	// If true, then the request bodies will be compressed using gzip.
+	Compress bool
+
+	// Level to use for gzip compression. See the compress/gzip package for
+	// the supported values.
+	CompressionLevel int
+
+	// Counters for the payloads that are sent. May be nil.
+	Stats *ClientStats
+
+	// Spool for payloads that fail with a retryable error. The spooled
+	// payloads will be replayed on the next call to Publish. May be nil.
+	Spool *Spool
+
+	// Maximum number of datapoints to send in a single request.
+	BatchSize int
+
+	// Maximum size in bytes of the encoded json for a single request. Use 0
+	// to only limit batches by the number of datapoints.
+	BatchBytes int
+
+	// Maximum number of batches from a single call to Publish that will be
+	// sent concurrently. When greater than 1, the batches may arrive at the
+	// server in a different order than they were created.
+	MaxConcurrency int
+
+	// Limiter shared across clients to bound the total number of in-flight
+	// requests for a URI. May be nil, in which case the limit only applies
+	// to a single call to Publish.
+	Limiter *RequestLimiter
+
+	// Rules for checking the datapoints before they are sent. May be nil, in
+	// which case all datapoints are sent and validation is left to the server.
+	Validation *ValidationOptions
+}
+
+// Returns the default settings used by NewAtlasClient.
+func DefaultClientOptions() ClientOptions {
+	return ClientOptions{
+		Retry:            DefaultRetryPolicy(),
+		HTTPClient:       defaultHTTPClient,
+		Compress:         false,
+		CompressionLevel: gzip.DefaultCompression,
+		BatchSize:        metricBatchSize,
+		BatchBytes:       defaultBatchBytes,
+		MaxConcurrency:   1,
+	}
+}
+
+// HTTP client that is used if one is not explicitly set in the options.
+var defaultHTTPClient = newHTTPClient(DefaultHTTPOptions())
+
 type httpAtlasClient struct {
 	uri string
 	commonTags map[string]string
+	options ClientOptions
+	sleep func(time.Duration)
 }
 
 // Create a new instance of an Atlas client using HTTP to talk to the default
@@ -57,7 +250,13 @@ type httpAtlasClient struct {
 // - commonTags: tags that should be applied to all datapoints being sent. This
 //   is typically used for infrastructure tags like the cluster and node.
 func NewAtlasClient(uri string, commonTags map[string]string) AtlasClient {
-	return httpAtlasClient{uri, sanitizeMap(commonTags)}
+	return NewAtlasClientWithOptions(uri, commonTags, DefaultClientOptions())
+}
+
+// Create a new instance of an Atlas client with custom settings. See
+// NewAtlasClient for a description of the other parameters.
+func NewAtlasClientWithOptions(uri string, commonTags map[string]string, options ClientOptions) AtlasClient {
+	return httpAtlasClient{uri, sanitizeMap(commonTags), options, time.Sleep}
 }
 
 // Helper for finding the minimum value of two integers. The built in
@@ -127,48 +326,197 @@ func sanitizeMap(tags map[string]string) map[string]string {
 	return copy
 }
 
-// Send all metrics in the array to the Atlas backend.
-func (client httpAtlasClient) Publish(metrics []Metric) {
+// Send all metrics in the array to the Atlas backend. If any of the batches
+// fail and could not be spooled, then a *PublishError will be returned with
+// the details.
+func (client httpAtlasClient) Publish(metrics []Metric) error {
+	_, err := client.PublishWithResult(metrics)
+	return err
+}
+
+// Same as Publish, but also returns the details for batches where the server
+// accepted the payload and rejected some of the datapoints.
+func (client httpAtlasClient) PublishWithResult(metrics []Metric) (*PublishResult, error) {
+	httpClient := client.options.HTTPClient
+	if httpClient == nil {
+		httpClient = defaultHTTPClient
+	}
+
 	f := func (data []byte) error {
-		response, err := http.Post(client.uri, "application/json", bytes.NewBuffer(data))
+		request, err := http.NewRequest("POST", client.uri, bytes.NewBuffer(data))
 		if err != nil {
 			return err
-		} else if response.StatusCode != 200 {
-			msg := fmt.Sprintf("status code %d", response.StatusCode)
-			body, err := ioutil.ReadAll(response.Body)
-			if err != nil {
-				msg = fmt.Sprintf("%s: %s", msg, string(body))
+		}
+		request.Header.Set("Content-Type", "application/json")
+		if client.options.Compress {
+			request.Header.Set("Content-Encoding", "gzip")
+		}
+
+		start := time.Now()
+		response, err := httpClient.Do(request)
+		if err != nil {
+			if client.options.Stats != nil {
+				client.options.Stats.recordRequest(0, time.Since(start))
 			}
-			return errors.New(msg)
+			return err
+		}
+		if client.options.Stats != nil {
+			client.options.Stats.recordRequest(response.StatusCode, time.Since(start))
 		}
+
+		// The body must be fully read and closed so that the connection can be
+		// reused for subsequent requests.
+		defer response.Body.Close()
+		if response.StatusCode == 202 || response.StatusCode == 400 {
+			body, _ := ioutil.ReadAll(response.Body)
+			if result, ok := parseValidationResult(body); ok {
+				return &rejectedError{response.StatusCode, string(body), result}
+			}
+			if response.StatusCode == 202 {
+				return nil
+			}
+			return &httpError{response.StatusCode, string(body), 0}
+		}
+		if response.StatusCode != 200 {
+			body, _ := ioutil.ReadAll(response.Body)
+			retryAfter := parseRetryAfter(response.Header.Get("Retry-After"), time.Now())
+			return &httpError{response.StatusCode, string(body), retryAfter}
+		}
+		io.Copy(ioutil.Discard, response.Body)
 		return nil
 	}
-	client.publish(metrics, f)
+	doPost := client.options.Retry.withRetries(client.uri, f, client.sleep)
+	client.replaySpool(doPost)
+	return client.publish(metrics, doPost)
+}
+
+// Send payloads that were previously spooled. This is done before sending new
+// data so that the datapoints arrive in order.
+func (client httpAtlasClient) replaySpool(doPost func([]byte) error) {
+	if client.options.Spool == nil {
+		return
+	}
+
+	logger := log.New()
+	n, err := client.options.Spool.Replay(func(data []byte) error {
+		var batch metricBatch
+		if err := json.Unmarshal(data, &batch); err != nil {
+			logger.Warnf("invalid payload in spool for %s: %v", client.uri, err)
+			return errCorruptRecord
+		}
+		_, err := client.sendPayload(data, len(batch.Metrics), doPost)
+		return err
+	})
+	if n > 0 {
+		logger.Infof("replayed %d spooled payloads to %s", n, client.uri)
+	}
+	if err != nil {
+		logger.Warnf("failed to replay spool for %s: %v", client.uri, err)
+	}
 }
 
-// Breakup the input array into batches and send them to Atlas.
-func (client httpAtlasClient) publish(metrics []Metric, doPost func([]byte) error) {
+// Breakup the input array into batches and send them to Atlas. Up to
+// MaxConcurrency batches will be sent at the same time. The failures in the
+// returned error and the partial failures in the result are ordered by the
+// batch index.
+func (client httpAtlasClient) publish(metrics []Metric, doPost func([]byte) error) (*PublishResult, error) {
 	logger := log.New()
+	if v := client.options.Validation; v != nil {
+		valid, dropped, err := v.filter(metrics, client.commonTags, time.Now())
+		if dropped > 0 {
+			if client.options.Stats != nil {
+				client.options.Stats.recordDropped(dropValidation, dropped)
+			}
+			logger.Warnf("dropped %d of %d datapoints for %s that failed validation, first failure: %v",
+				dropped, len(metrics), client.uri, err)
+		}
+		metrics = valid
+	}
+
+	result := &PublishResult{}
+	var failures []BatchFailure
 	n := len(metrics)
 	if n == 0 {
 		logger.Infof("empty metric list, nothing to send")
 	} else {
 		logger.Infof("sending %d metrics to %s", n, client.uri)
-		for i := 0; i < n; i += metricBatchSize {
-			end := min(i + metricBatchSize, n)
-			sanitizedBatch := make([]Metric, end - i)
-			for j := range metrics[i:end] {
-				sanitizedBatch[j] = Metric{
-					sanitizeMap(metrics[j].Tags),
-					metrics[j].Timestamp,
-					metrics[j].Value,
-				}
+		batchSize := client.options.BatchSize
+		if batchSize <= 0 {
+			batchSize = metricBatchSize
+		}
+		batches := newBatchIterator(metrics, client.commonTags, batchSize, client.options.BatchBytes)
+
+		// Limit for this call to Publish, the shared limiter is also acquired
+		// if present so the number of requests in flight for the URI is bounded.
+		local := NewRequestLimiter(client.options.MaxConcurrency)
+		shared := client.options.Limiter
+
+		var mutex sync.Mutex
+		var wg sync.WaitGroup
+		for i := 0; ; i++ {
+			batch, ok := batches.next()
+			if !ok {
+				break
+			}
+			local.acquire()
+			if shared != nil {
+				shared.acquire()
 			}
-			client.sendToAtlas(sanitizedBatch, doPost)
+			wg.Add(1)
+			go func(i int, batch []Metric) {
+				defer wg.Done()
+				defer local.release()
+				if shared != nil {
+					defer shared.release()
+				}
+				partial, err := client.sendToAtlas(batch, doPost)
+				if client.options.Stats != nil {
+					client.options.Stats.recordBatch(err == nil)
+				}
+				mutex.Lock()
+				if err != nil {
+					failures = append(failures, newBatchFailure(i, len(batch), err))
+				} else if partial != nil {
+					result.Partial = append(result.Partial, newBatchFailure(i, partial.Result.Rejected, partial))
+				}
+				mutex.Unlock()
+			}(i, batch)
 		}
+		wg.Wait()
+	}
+	sort.Sort(batchFailures(result.Partial))
+
+	// If all of the failed batches were spooled, then no data has been lost
+	// yet. Returning an error would cause snap to disable the task after
+	// repeated failures during the outage the spool is meant to cover.
+	if len(failures) > 0 && allSpooled(failures) {
+		logger.Warnf("spooled %d batches for %s to be sent later", len(failures), client.uri)
+		return result, nil
 	}
+	if len(failures) > 0 {
+		sort.Sort(batchFailures(failures))
+		return result, &PublishError{client.uri, failures}
+	}
+	return result, nil
 }
 
+// Returns true if all of the failed batches were written to the spool.
+func allSpooled(failures []BatchFailure) bool {
+	for _, f := range failures {
+		if !f.Spooled {
+			return false
+		}
+	}
+	return true
+}
+
+// Sort the batch failures by the index of the batch.
+type batchFailures []BatchFailure
+
+func (fs batchFailures) Len() int           { return len(fs) }
+func (fs batchFailures) Less(i, j int) bool { return fs[i].Batch < fs[j].Batch }
+func (fs batchFailures) Swap(i, j int)      { fs[i], fs[j] = fs[j], fs[i] }
+
 // Filter out floating point values like that are not supported by standard json
 // like infinity and NaN.
 func (client httpAtlasClient) filterNumbers(metrics []Metric) []Metric {
@@ -178,23 +526,80 @@ func (client httpAtlasClient) filterNumbers(metrics []Metric) []Metric {
 			buffer = append(buffer, m)
 		}
 	}
+	if client.options.Stats != nil {
+		client.options.Stats.recordDropped(dropNaN, len(metrics)-len(buffer))
+	}
 	return buffer
 }
 
-// Encode the data as json and send to the backend.
-func (client httpAtlasClient) sendToAtlas(metrics []Metric, doPost func([]byte) error) {
+// Encode the data as json and send to the backend. If the server accepted the
+// payload, but rejected some of the datapoints, then the details will be
+// returned along with a nil error.
+func (client httpAtlasClient) sendToAtlas(metrics []Metric, doPost func([]byte) error) (*rejectedError, error) {
 	logger := log.New()
 
 	batch := metricBatch{client.commonTags, client.filterNumbers(metrics)}
 	json, err := json.Marshal(batch)
 	if err != nil {
 		logger.Errorf("failed to encode metrics as json: %v", err)
+		return nil, err
+	}
+
+	partial, err := client.sendPayload(json, len(batch.Metrics), doPost)
+	if err == nil {
+		logger.Infof("successfully sent %d metrics to %s", len(metrics), client.uri)
+	} else if client.options.Spool != nil && isRetryable(err) {
+		if spoolErr := client.options.Spool.Append(json); spoolErr != nil {
+			logger.Errorf("failed to spool payload for %s: %v", client.uri, spoolErr)
+		} else {
+			return nil, &spooledError{err}
+		}
 	}
+	return partial, err
+}
+
+// Compress, if enabled, and send the encoded json payload to the backend. The
+// size is the number of datapoints in the payload. If the server accepts the
+// payload, but rejects some of the datapoints, then the rejected datapoints
+// are logged and the details are returned along with a nil error.
+func (client httpAtlasClient) sendPayload(json []byte, size int, doPost func([]byte) error) (*rejectedError, error) {
+	logger := log.New()
 
-	err = doPost(json)
+	var err error
+	payload := json
+	if client.options.Compress {
+		payload, err = gzipPayload(json, client.options.CompressionLevel)
+		if err != nil {
+			logger.Errorf("failed to compress payload: %v", err)
+			return nil, err
+		}
+		logger.Debugf("compressed payload from %d to %d bytes", len(json), len(payload))
+	}
+
+	var partial *rejectedError
+	err = doPost(payload)
+	if e, ok := err.(*rejectedError); ok {
+		e.Result.Accepted = size - e.Result.Rejected
+		if e.Result.Accepted < 0 {
+			e.Result.Accepted = 0
+		}
+		if client.options.Stats != nil {
+			client.options.Stats.recordDropped(dropRejected, e.Result.Rejected)
+		}
+		logRejected(client.uri, e.Result, rejectionLog, time.Now())
+		if e.StatusCode == 202 {
+			logger.Infof("%d of %d datapoints were rejected by %s", e.Result.Rejected, size, client.uri)
+			partial = e
+			err = nil
+		}
+	}
 	if err != nil {
 		logger.Errorf("post to %v failed: %v", client.uri, err)
 	} else {
-		logger.Infof("successfully sent %d metrics to %s", len(metrics), client.uri)
+		if client.options.Stats != nil {
+			client.options.Stats.recordPayload(len(json), len(payload))
+		}
+		logger.Debugf("sent payload of %d bytes to %s", len(payload), client.uri)
 	}
+	return partial, err
 }
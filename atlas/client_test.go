@@ -16,9 +16,17 @@
 package atlas
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -144,5 +152,204 @@ func TestClient(t *testing.T) {
 		So(string(payload), ShouldResemble, fmt.Sprintf(envelope, "[]"))
 	})
 
-}
+	Convey("publish returns failures for each batch", t, func() {
+		client := NewAtlasClient("/api/v1/publish", map[string]string{}).(httpAtlasClient)
+
+		f := func (data []byte) error {
+			return &httpError{503, "unavailable", 0}
+		}
+
+		metrics := []Metric{
+			Metric{map[string]string{"name": "foo"}, 0, 1.0},
+			Metric{map[string]string{"name": "bar"}, 0, 2.0},
+		}
+
+		_, err := client.publish(metrics, f)
+		So(err, ShouldNotBeNil)
+
+		publishErr := err.(*PublishError)
+		So(publishErr.URI, ShouldEqual, "/api/v1/publish")
+		So(len(publishErr.Failures), ShouldEqual, 1)
+		So(publishErr.Failures[0].Batch, ShouldEqual, 0)
+		So(publishErr.Failures[0].StatusCode, ShouldEqual, 503)
+		So(publishErr.Failures[0].Body, ShouldEqual, "unavailable")
+		So(publishErr.Failures[0].Dropped, ShouldEqual, 2)
+		So(publishErr.Dropped(), ShouldEqual, 2)
+	})
+
+	Convey("publish connection error", t, func() {
+		client := NewAtlasClient("/api/v1/publish", map[string]string{}).(httpAtlasClient)
+
+		f := func (data []byte) error {
+			return errors.New("connection refused")
+		}
+
+		metrics := []Metric{
+			Metric{map[string]string{"name": "foo"}, 0, 1.0},
+		}
 
+		_, publishErr := client.publish(metrics, f)
+		err := publishErr.(*PublishError)
+		So(err.Failures[0].StatusCode, ShouldEqual, 0)
+		So(err.Failures[0].Err.Error(), ShouldEqual, "connection refused")
+		So(err.Error(), ShouldContainSubstring, "batch 0: connection refused")
+	})
+
+	Convey("publish success", t, func() {
+		client := NewAtlasClient("/api/v1/publish", map[string]string{}).(httpAtlasClient)
+
+		f := func (data []byte) error {
+			return nil
+		}
+
+		result, err := client.publish([]Metric{}, f)
+		So(err, ShouldBeNil)
+		So(result.Partial, ShouldBeEmpty)
+
+		result, err = client.publish([]Metric{
+			Metric{map[string]string{"name": "foo"}, 0, 1.0},
+		}, f)
+		So(err, ShouldBeNil)
+		So(result.Partial, ShouldBeEmpty)
+	})
+
+	Convey("publish sends batches concurrently", t, func() {
+		options := DefaultClientOptions()
+		options.BatchSize = 1
+		options.MaxConcurrency = 4
+		client := NewAtlasClientWithOptions("/api/v1/publish", map[string]string{}, options).(httpAtlasClient)
+
+		var active, maxActive, requests int32
+		f := func(data []byte) error {
+			n := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			atomic.AddInt32(&requests, 1)
+			for {
+				m := atomic.LoadInt32(&maxActive)
+				if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			return nil
+		}
+
+		metrics := make([]Metric, 20)
+		for i := range metrics {
+			metrics[i] = Metric{map[string]string{"name": fmt.Sprintf("m%d", i)}, 0, 1.0}
+		}
+		_, err := client.publish(metrics, f)
+		So(err, ShouldBeNil)
+		So(requests, ShouldEqual, 20)
+		So(maxActive, ShouldBeLessThanOrEqualTo, 4)
+		So(maxActive, ShouldBeGreaterThan, 1)
+	})
+
+	Convey("publish concurrent failures are ordered by batch", t, func() {
+		options := DefaultClientOptions()
+		options.BatchSize = 1
+		options.MaxConcurrency = 8
+		client := NewAtlasClientWithOptions("/api/v1/publish", map[string]string{}, options).(httpAtlasClient)
+
+		f := func(data []byte) error {
+			time.Sleep(time.Millisecond)
+			return &httpError{503, "unavailable", 0}
+		}
+
+		metrics := make([]Metric, 10)
+		for i := range metrics {
+			metrics[i] = Metric{map[string]string{"name": "foo"}, 0, 1.0}
+		}
+		_, publishErr := client.publish(metrics, f)
+		err := publishErr.(*PublishError)
+		So(len(err.Failures), ShouldEqual, 10)
+		for i, failure := range err.Failures {
+			So(failure.Batch, ShouldEqual, i)
+			So(failure.Dropped, ShouldEqual, 1)
+		}
+		So(err.Dropped(), ShouldEqual, 10)
+	})
+
+	Convey("publish respects the shared limiter", t, func() {
+		limiter := NewRequestLimiter(2)
+		options := DefaultClientOptions()
+		options.BatchSize = 1
+		options.MaxConcurrency = 4
+		options.Limiter = limiter
+
+		var mutex sync.Mutex
+		active, maxActive := 0, 0
+		f := func(data []byte) error {
+			mutex.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mutex.Unlock()
+			time.Sleep(2 * time.Millisecond)
+			mutex.Lock()
+			active--
+			mutex.Unlock()
+			return nil
+		}
+
+		metrics := make([]Metric, 8)
+		for i := range metrics {
+			metrics[i] = Metric{map[string]string{"name": "foo"}, 0, 1.0}
+		}
+
+		// Two concurrent calls to Publish share the limit
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				client := NewAtlasClientWithOptions("/api/v1/publish", map[string]string{}, options).(httpAtlasClient)
+				client.publish(metrics, f)
+			}()
+		}
+		wg.Wait()
+		So(maxActive, ShouldBeLessThanOrEqualTo, 2)
+	})
+
+	Convey("Publish with error response from server", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(400)
+			w.Write([]byte("invalid datapoints"))
+		}))
+		defer server.Close()
+
+		client := NewAtlasClient(server.URL, map[string]string{})
+		err := client.Publish([]Metric{
+			Metric{map[string]string{"name": "foo"}, 0, 1.0},
+		}).(*PublishError)
+		So(err.Failures[0].StatusCode, ShouldEqual, 400)
+		So(err.Failures[0].Body, ShouldEqual, "invalid datapoints")
+	})
+
+	Convey("Publish with an unsupported scheme is not retried or spooled", t, func() {
+		dir, _ := ioutil.TempDir("", "atlas-spool")
+		defer os.RemoveAll(dir)
+		spoolOptions := DefaultSpoolOptions()
+		spoolOptions.Dir = dir
+		spool, err := OpenSpool(spoolOptions)
+		So(err, ShouldBeNil)
+		defer spool.Close()
+
+		options := DefaultClientOptions()
+		options.Spool = spool
+		client := NewAtlasClientWithOptions("foo://localhost/api/v1/publish", map[string]string{}, options).(httpAtlasClient)
+		retries := 0
+		client.sleep = func(d time.Duration) {
+			retries++
+		}
+
+		publishErr := client.Publish([]Metric{
+			Metric{map[string]string{"name": "foo"}, 0, 1.0},
+		}).(*PublishError)
+		So(publishErr.Failures[0].Spooled, ShouldBeFalse)
+		So(publishErr.Dropped(), ShouldEqual, 1)
+		So(retries, ShouldEqual, 0)
+		So(spool.Size(), ShouldEqual, 0)
+	})
+}
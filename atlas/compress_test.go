@@ -0,0 +1,109 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func gunzip(data []byte) string {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		panic(err)
+	}
+	decompressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		panic(err)
+	}
+	return string(decompressed)
+}
+
+func TestCompress(t *testing.T) {
+
+	Convey("checkCompressionLevel", t, func() {
+		So(checkCompressionLevel(gzip.DefaultCompression), ShouldBeNil)
+		So(checkCompressionLevel(gzip.NoCompression), ShouldBeNil)
+		So(checkCompressionLevel(gzip.BestSpeed), ShouldBeNil)
+		So(checkCompressionLevel(gzip.BestCompression), ShouldBeNil)
+		So(checkCompressionLevel(-2), ShouldNotBeNil)
+		So(checkCompressionLevel(10), ShouldNotBeNil)
+	})
+
+	Convey("gzipPayload", t, func() {
+		data := []byte(strings.Repeat("{\"name\":\"foo\"}", 100))
+		compressed, err := gzipPayload(data, gzip.BestCompression)
+		So(err, ShouldBeNil)
+		So(len(compressed), ShouldBeLessThan, len(data))
+		So(gunzip(compressed), ShouldEqual, string(data))
+
+		_, err = gzipPayload(data, 42)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Publish compressed payload", t, func() {
+		var encoding string
+		var payload map[string]interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding = r.Header.Get("Content-Encoding")
+			body, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal([]byte(gunzip(body)), &payload)
+		}))
+		defer server.Close()
+
+		options := DefaultClientOptions()
+		options.Compress = true
+		options.Stats = &ClientStats{}
+
+		metrics := make([]Metric, 100)
+		for i := range metrics {
+			metrics[i] = Metric{map[string]string{"name": "foo", "nf.app": "bar"}, 0, 1.0}
+		}
+
+		client := NewAtlasClientWithOptions(server.URL, map[string]string{"nf.app": "foo"}, options)
+		So(client.Publish(metrics), ShouldBeNil)
+		So(encoding, ShouldEqual, "gzip")
+		So(payload["tags"], ShouldResemble, map[string]interface{}{"nf.app": "foo"})
+		So(len(payload["metrics"].([]interface{})), ShouldEqual, 100)
+		So(options.Stats.SentBytes(), ShouldBeLessThan, options.Stats.PayloadBytes())
+		So(options.Stats.BytesSaved(), ShouldBeGreaterThan, 0)
+	})
+
+	Convey("Publish uncompressed payload", t, func() {
+		var encoding string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding = r.Header.Get("Content-Encoding")
+		}))
+		defer server.Close()
+
+		options := DefaultClientOptions()
+		options.Stats = &ClientStats{}
+
+		client := NewAtlasClientWithOptions(server.URL, map[string]string{}, options)
+		So(client.Publish([]Metric{Metric{map[string]string{"name": "foo"}, 0, 1.0}}), ShouldBeNil)
+		So(encoding, ShouldEqual, "")
+		So(options.Stats.SentBytes(), ShouldEqual, options.Stats.PayloadBytes())
+		So(options.Stats.BytesSaved(), ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,450 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+// Get a string value from the config or return the default if it is not
+// present.
+func getString(config map[string]ctypes.ConfigValue, key string, dflt string) string {
+	if v, ok := config[key].(ctypes.ConfigValueStr); ok {
+		return v.Value
+	}
+	return dflt
+}
+
+// Get an integer value from the config or return the default if it is not
+// present.
+func getInt(config map[string]ctypes.ConfigValue, key string, dflt int) int {
+	if v, ok := config[key].(ctypes.ConfigValueInt); ok {
+		return v.Value
+	}
+	return dflt
+}
+
+// Get a floating point value from the config or return the default if it is
+// not present. Integer values will get converted.
+func getFloat(config map[string]ctypes.ConfigValue, key string, dflt float64) float64 {
+	switch v := config[key].(type) {
+	case ctypes.ConfigValueFloat:
+		return v.Value
+	case ctypes.ConfigValueInt:
+		return float64(v.Value)
+	default:
+		return dflt
+	}
+}
+
+// Get a boolean value from the config or return the default if it is not
+// present.
+func getBool(config map[string]ctypes.ConfigValue, key string, dflt bool) bool {
+	if v, ok := config[key].(ctypes.ConfigValueBool); ok {
+		return v.Value
+	}
+	return dflt
+}
+
+// Get a duration specified as an integer number of milliseconds from the
+// config or return the default if it is not present.
+func getMillis(config map[string]ctypes.ConfigValue, key string, dflt time.Duration) time.Duration {
+	if v, ok := config[key].(ctypes.ConfigValueInt); ok {
+		return time.Duration(v.Value) * time.Millisecond
+	}
+	return dflt
+}
+
+// Create the retry policy based on the config.
+func getRetryPolicy(config map[string]ctypes.ConfigValue) RetryPolicy {
+	dflt := DefaultRetryPolicy()
+	return RetryPolicy{
+		MaxAttempts:    getInt(config, "retry_max_attempts", dflt.MaxAttempts),
+		InitialBackoff: getMillis(config, "retry_initial_backoff_ms", dflt.InitialBackoff),
+		MaxBackoff:     getMillis(config, "retry_max_backoff_ms", dflt.MaxBackoff),
+		Jitter:         getFloat(config, "retry_jitter", dflt.Jitter),
+	}
+}
+
+// Create the HTTP client settings based on the config.
+func getHTTPOptions(config map[string]ctypes.ConfigValue) (HTTPOptions, error) {
+	dflt := DefaultHTTPOptions()
+	options := HTTPOptions{
+		ConnectTimeout:         getMillis(config, "connect_timeout_ms", dflt.ConnectTimeout),
+		RequestTimeout:         getMillis(config, "request_timeout_ms", dflt.RequestTimeout),
+		MaxIdleConns:           getInt(config, "max_idle_conns", dflt.MaxIdleConns),
+		KeepAlive:              getMillis(config, "keep_alive_ms", dflt.KeepAlive),
+		DisableConnectionReuse: getBool(config, "disable_connection_reuse", dflt.DisableConnectionReuse),
+	}
+	if err := checkHTTPOptions(options); err != nil {
+		return options, err
+	}
+	return options, nil
+}
+
+// Create the client settings based on the config. The HTTP client depends on
+// the URI, so the caller should replace the default with one from the pool so
+// that connections are reused across calls.
+func getClientOptions(config map[string]ctypes.ConfigValue) (ClientOptions, error) {
+	options := DefaultClientOptions()
+	options.Retry = getRetryPolicy(config)
+	if err := checkRetryPolicy(options.Retry); err != nil {
+		return options, err
+	}
+	options.Compress = getBool(config, "compress", options.Compress)
+	options.CompressionLevel = getInt(config, "compression_level", options.CompressionLevel)
+	if err := checkCompressionLevel(options.CompressionLevel); err != nil {
+		return options, err
+	}
+	options.BatchSize = getInt(config, "batch_size", options.BatchSize)
+	options.BatchBytes = getInt(config, "batch_max_bytes", options.BatchBytes)
+	if err := checkBatchLimits(options.BatchSize, options.BatchBytes); err != nil {
+		return options, err
+	}
+	options.MaxConcurrency = getInt(config, "max_concurrency", options.MaxConcurrency)
+	if options.MaxConcurrency < 1 {
+		return options, fmt.Errorf("invalid max concurrency %d, must be greater than 0", options.MaxConcurrency)
+	}
+	if getBool(config, "validate", true) {
+		validation, err := getValidationOptions(config)
+		if err != nil {
+			return options, err
+		}
+		options.Validation = &validation
+	}
+	return options, nil
+}
+
+// Create the settings for validating datapoints before they are sent.
+func getValidationOptions(config map[string]ctypes.ConfigValue) (ValidationOptions, error) {
+	options := DefaultValidationOptions()
+	options.MaxUserTags = getInt(config, "max_user_tags", options.MaxUserTags)
+	options.MaxKeyLength = getInt(config, "max_key_length", options.MaxKeyLength)
+	options.MaxValueLength = getInt(config, "max_value_length", options.MaxValueLength)
+	options.MaxAge = getMillis(config, "max_age_ms", options.MaxAge)
+	options.MaxFuture = getMillis(config, "max_future_ms", options.MaxFuture)
+
+	fix, err := parseInvalidAction(getString(config, "invalid_action", "drop"))
+	if err != nil {
+		return options, err
+	}
+	options.Fix = fix
+
+	if err := checkValidationOptions(options); err != nil {
+		return options, err
+	}
+	return options, nil
+}
+
+// Prefix for config keys that specify a single common tag, e.g. a key of
+// "tag.nf.app" will set the common tag "nf.app".
+const commonTagPrefix = "tag."
+
+// Parse a list of key value pairs in the form "k1=v1,k2=v2".
+func parseKeyValueList(s string) (map[string]string, error) {
+	pairs := map[string]string{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pos := strings.Index(entry, "=")
+		if pos <= 0 {
+			return nil, fmt.Errorf("invalid entry '%s', expected key=value", entry)
+		}
+		pairs[strings.TrimSpace(entry[:pos])] = strings.TrimSpace(entry[pos+1:])
+	}
+	return pairs, nil
+}
+
+// Get the common tags that should be applied to all datapoints. Tags can be
+// specified as a list using the "tags" key or individually using keys with a
+// prefix of "tag.". Individual keys take precedence over the list. Values can
+// refer to environment variables using the form {VARNAME}.
+func getCommonTags(config map[string]ctypes.ConfigValue, env map[string]string) (map[string]string, error) {
+	tags, err := parseKeyValueList(getString(config, "tags", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid tags config: %v", err)
+	}
+
+	for k, v := range config {
+		if strings.HasPrefix(k, commonTagPrefix) && len(k) > len(commonTagPrefix) {
+			if s, ok := v.(ctypes.ConfigValueStr); ok {
+				tags[k[len(commonTagPrefix):]] = s.Value
+			}
+		}
+	}
+
+	for k, v := range tags {
+		tags[k] = substitute(v, env)
+	}
+	return tags, nil
+}
+
+// Create the settings for the background sender based on the config.
+func getSenderOptions(config map[string]ctypes.ConfigValue) (senderOptions, error) {
+	options := defaultSenderOptions()
+	options.QueueSize = getInt(config, "queue_size", options.QueueSize)
+	options.FlushInterval = getMillis(config, "flush_interval_ms", options.FlushInterval)
+	options.FlushSize = getInt(config, "flush_size", options.FlushSize)
+
+	policy, err := parseDropPolicy(getString(config, "drop_policy", "drop-oldest"))
+	if err != nil {
+		return options, err
+	}
+	options.DropPolicy = policy
+
+	if options.QueueSize <= 0 {
+		return options, fmt.Errorf("queue_size must be positive: %d", options.QueueSize)
+	}
+	if options.FlushInterval <= 0 {
+		return options, fmt.Errorf("flush_interval_ms must be positive: %d", options.FlushInterval / time.Millisecond)
+	}
+	return options, nil
+}
+
+// Create the settings for the spool based on the config. The directory will
+// be empty if spooling is disabled. Otherwise, it is the base directory from
+// the config, see getSpoolDir for the directory used for a given URI.
+func getSpoolOptions(config map[string]ctypes.ConfigValue) (SpoolOptions, error) {
+	options := DefaultSpoolOptions()
+	options.Dir = getString(config, "spool_dir", "")
+	options.MaxBytes = int64(getInt(config, "spool_max_bytes", int(options.MaxBytes)))
+	options.MaxAge = getMillis(config, "spool_max_age_ms", options.MaxAge)
+	options.SegmentBytes = int64(getInt(config, "spool_segment_bytes", int(options.SegmentBytes)))
+	if err := checkSpoolOptions(options); err != nil {
+		return options, err
+	}
+	return options, nil
+}
+
+// Get the spool directory for a URI. Each URI gets a separate sub-directory
+// so that multiple endpoints can share the same spool directory. The base
+// directory can refer to environment variables using the form {VARNAME}.
+func getSpoolDir(dir string, uri string, env map[string]string) string {
+	return filepath.Join(substitute(dir, env), fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(uri))))
+}
+
+// Get the pattern on the namespace used to identify counters. Returns nil if
+// no pattern is specified.
+func getCounterPattern(config map[string]ctypes.ConfigValue) (*regexp.Regexp, error) {
+	pattern := getString(config, "counter_pattern", "")
+	if pattern == "" {
+		return nil, nil
+	}
+	r, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid counter_pattern '%s': %v", pattern, err)
+	}
+	return r, nil
+}
+
+// Get the rules for setting the atlas.dstype tag.
+func getDstypeRules(config map[string]ctypes.ConfigValue) (*dstypeRules, error) {
+	return parseDstypeRules(getString(config, "dstype_rules", ""), getString(config, "dstype_default", "gauge"))
+}
+
+// Get the rules for choosing the statistic used when aggregating datapoints
+// within a step.
+func getAggregationRules(config map[string]ctypes.ConfigValue) (aggregationRules, error) {
+	return parseAggregationRules(getString(config, "aggregation_rules", ""))
+}
+
+// Get the settings for creating the Atlas tags from the snap tags.
+func getTagOptions(config map[string]ctypes.ConfigValue) (*tagOptions, error) {
+	options := &tagOptions{ignored: map[string]bool{}, templates: newTemplateCache()}
+	for _, k := range strings.Split(getString(config, "ignore_tags", "unit,plugin_running_on"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			options.ignored[k] = true
+		}
+	}
+
+	mapping, err := parseKeyValueList(getString(config, "tag_mapping", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag_mapping: %v", err)
+	}
+	for k, v := range mapping {
+		if v == "" {
+			return nil, fmt.Errorf("invalid tag_mapping: empty key for '%s'", k)
+		}
+	}
+	options.mapping = mapping
+
+	options.names, err = parseNameRules(getString(config, "name_rules", ""))
+	if err != nil {
+		return nil, err
+	}
+	options.strict = getBool(config, "strict_templates", false)
+
+	options.dstypes, err = getDstypeRules(config)
+	if err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// Get the numeric values to use for enum strings.
+func getValueMapping(config map[string]ctypes.ConfigValue) (map[string]float64, error) {
+	pairs, err := parseKeyValueList(getString(config, "value_mapping", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid value_mapping: %v", err)
+	}
+	mapping := make(map[string]float64, len(pairs))
+	for k, v := range pairs {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value_mapping: value for '%s' is not a number: '%s'", k, v)
+		}
+		mapping[k] = n
+	}
+	return mapping, nil
+}
+
+// Get the settings for converting the values of each metric.
+func getValueOptions(config map[string]ctypes.ConfigValue) (*valueOptions, error) {
+	mapping, err := getValueMapping(config)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &valueOptions{mapping: mapping, unitTag: getString(config, "unit_tag", "")}
+	switch dataUnit := getString(config, "data_unit", "bytes"); dataUnit {
+	case "bytes":
+	case "bits":
+		options.bits = true
+	default:
+		return nil, fmt.Errorf("invalid data_unit '%s', must be bytes or bits", dataUnit)
+	}
+	return options, nil
+}
+
+// Get the rules for rewriting the tags of each metric.
+func getTagRules(config map[string]ctypes.ConfigValue) (tagRules, error) {
+	return parseTagRules(getString(config, "tag_rules", ""))
+}
+
+// Get the patterns for a key in the config.
+func getMatchers(config map[string]ctypes.ConfigValue, key string) ([]*matcher, error) {
+	patterns := splitPatterns(getString(config, key, ""))
+	var matchers []*matcher
+	for _, p := range patterns {
+		m, err := parseMatcher(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+// Get the filter based on the include and exclude patterns or return nil if
+// no patterns are present.
+func getFilter(config map[string]ctypes.ConfigValue) (*metricFilter, error) {
+	include, err := getMatchers(config, "include")
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := getMatchers(config, "exclude")
+	if err != nil {
+		return nil, err
+	}
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	return &metricFilter{include: include, exclude: exclude}, nil
+}
+
+// Maximum number of distinct configs to keep compiled. Typically there is
+// one per task so the limit should only be reached if the config is changing
+// frequently, in which case the cache is cleared.
+const maxCompiledConfigs = 100
+
+// Patterns and rules parsed from the config that are needed to convert the
+// metrics for each publish.
+type compiledConfig struct {
+	filter      *metricFilter
+	counters    *regexp.Regexp
+	tagOptions  *tagOptions
+	aggregation aggregationRules
+	tagRules    tagRules
+	values      *valueOptions
+	client      ClientOptions
+	http        HTTPOptions
+	spool       SpoolOptions
+	sender      senderOptions
+}
+
+// Validate and compile the patterns and rules in the config.
+func compileConfig(config map[string]ctypes.ConfigValue) (*compiledConfig, error) {
+	var err error
+	compiled := &compiledConfig{}
+	if compiled.filter, err = getFilter(config); err != nil {
+		return nil, err
+	}
+	if compiled.counters, err = getCounterPattern(config); err != nil {
+		return nil, err
+	}
+	if compiled.tagOptions, err = getTagOptions(config); err != nil {
+		return nil, err
+	}
+	if compiled.aggregation, err = getAggregationRules(config); err != nil {
+		return nil, err
+	}
+	if compiled.tagRules, err = getTagRules(config); err != nil {
+		return nil, err
+	}
+	if compiled.values, err = getValueOptions(config); err != nil {
+		return nil, err
+	}
+	if compiled.client, err = getClientOptions(config); err != nil {
+		return nil, err
+	}
+	if compiled.http, err = getHTTPOptions(config); err != nil {
+		return nil, err
+	}
+	if compiled.spool, err = getSpoolOptions(config); err != nil {
+		return nil, err
+	}
+	if compiled.sender, err = getSenderOptions(config); err != nil {
+		return nil, err
+	}
+	return compiled, nil
+}
+
+// Create a string key that uniquely identifies a config.
+func configKey(config map[string]ctypes.ConfigValue) string {
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buffer bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&buffer, "%q=%#v;", k, config[k])
+	}
+	return buffer.String()
+}
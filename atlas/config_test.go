@@ -0,0 +1,517 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfig(t *testing.T) {
+
+	config := map[string]ctypes.ConfigValue{
+		"str":   ctypes.ConfigValueStr{Value: "foo"},
+		"int":   ctypes.ConfigValueInt{Value: 42},
+		"float": ctypes.ConfigValueFloat{Value: 0.5},
+		"bool":  ctypes.ConfigValueBool{Value: true},
+	}
+
+	Convey("getString", t, func() {
+		So(getString(config, "str", "bar"), ShouldEqual, "foo")
+		So(getString(config, "missing", "bar"), ShouldEqual, "bar")
+		So(getString(config, "int", "bar"), ShouldEqual, "bar")
+	})
+
+	Convey("getInt", t, func() {
+		So(getInt(config, "int", 1), ShouldEqual, 42)
+		So(getInt(config, "missing", 1), ShouldEqual, 1)
+		So(getInt(config, "str", 1), ShouldEqual, 1)
+	})
+
+	Convey("getFloat", t, func() {
+		So(getFloat(config, "float", 1.0), ShouldEqual, 0.5)
+		So(getFloat(config, "int", 1.0), ShouldEqual, 42.0)
+		So(getFloat(config, "missing", 1.0), ShouldEqual, 1.0)
+	})
+
+	Convey("getBool", t, func() {
+		So(getBool(config, "bool", false), ShouldBeTrue)
+		So(getBool(config, "missing", false), ShouldBeFalse)
+	})
+
+	Convey("getMillis", t, func() {
+		So(getMillis(config, "int", time.Second), ShouldEqual, 42*time.Millisecond)
+		So(getMillis(config, "missing", time.Second), ShouldEqual, time.Second)
+	})
+
+	Convey("getRetryPolicy", t, func() {
+		So(getRetryPolicy(map[string]ctypes.ConfigValue{}), ShouldResemble, DefaultRetryPolicy())
+
+		policy := getRetryPolicy(map[string]ctypes.ConfigValue{
+			"retry_max_attempts":       ctypes.ConfigValueInt{Value: 5},
+			"retry_initial_backoff_ms": ctypes.ConfigValueInt{Value: 10},
+			"retry_max_backoff_ms":     ctypes.ConfigValueInt{Value: 1000},
+			"retry_jitter":             ctypes.ConfigValueFloat{Value: 0.1},
+		})
+		So(policy, ShouldResemble, RetryPolicy{5, 10 * time.Millisecond, time.Second, 0.1})
+	})
+
+	Convey("getHTTPOptions", t, func() {
+		options, err := getHTTPOptions(map[string]ctypes.ConfigValue{})
+		So(err, ShouldBeNil)
+		So(options, ShouldResemble, DefaultHTTPOptions())
+
+		options, err = getHTTPOptions(map[string]ctypes.ConfigValue{
+			"connect_timeout_ms":       ctypes.ConfigValueInt{Value: 100},
+			"request_timeout_ms":       ctypes.ConfigValueInt{Value: 1000},
+			"max_idle_conns":           ctypes.ConfigValueInt{Value: 2},
+			"keep_alive_ms":            ctypes.ConfigValueInt{Value: 0},
+			"disable_connection_reuse": ctypes.ConfigValueBool{Value: true},
+		})
+		So(err, ShouldBeNil)
+		So(options, ShouldResemble, HTTPOptions{100 * time.Millisecond, time.Second, 2, 0, true})
+
+		// Timeouts must be set so a hung endpoint cannot block publishing
+		for _, key := range []string{"connect_timeout_ms", "request_timeout_ms"} {
+			_, err = getHTTPOptions(map[string]ctypes.ConfigValue{
+				key: ctypes.ConfigValueInt{Value: 0},
+			})
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("parseKeyValueList", t, func() {
+		pairs, err := parseKeyValueList("")
+		So(err, ShouldBeNil)
+		So(pairs, ShouldResemble, map[string]string{})
+
+		pairs, err = parseKeyValueList("a=1, b = 2,,c=x=y")
+		So(err, ShouldBeNil)
+		So(pairs, ShouldResemble, map[string]string{"a": "1", "b": "2", "c": "x=y"})
+
+		_, err = parseKeyValueList("a=1,b")
+		So(err, ShouldNotBeNil)
+
+		_, err = parseKeyValueList("=1")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("getCommonTags", t, func() {
+		env := map[string]string{
+			"NETFLIX_APP":     "foo",
+			"NETFLIX_CLUSTER": "foo-main",
+		}
+
+		tags, err := getCommonTags(map[string]ctypes.ConfigValue{}, env)
+		So(err, ShouldBeNil)
+		So(tags, ShouldResemble, map[string]string{})
+
+		tags, err = getCommonTags(map[string]ctypes.ConfigValue{
+			"tags":        ctypes.ConfigValueStr{Value: "nf.app={NETFLIX_APP},nf.cluster={NETFLIX_CLUSTER},nf.node=i-1"},
+			"tag.nf.node": ctypes.ConfigValueStr{Value: "i-2"},
+			"tag.nf.zone": ctypes.ConfigValueStr{Value: "us-east-1e"},
+			"tag.":        ctypes.ConfigValueStr{Value: "ignored"},
+		}, env)
+		So(err, ShouldBeNil)
+		So(tags, ShouldResemble, map[string]string{
+			"nf.app":     "foo",
+			"nf.cluster": "foo-main",
+			"nf.node":    "i-2",
+			"nf.zone":    "us-east-1e",
+		})
+
+		_, err = getCommonTags(map[string]ctypes.ConfigValue{
+			"tags": ctypes.ConfigValueStr{Value: "nf.app"},
+		}, env)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("getClientOptions", t, func() {
+		options, err := getClientOptions(map[string]ctypes.ConfigValue{})
+		So(err, ShouldBeNil)
+		So(options.Compress, ShouldBeFalse)
+		So(options.MaxConcurrency, ShouldEqual, 1)
+		So(*options.Validation, ShouldResemble, DefaultValidationOptions())
+
+		options, err = getClientOptions(map[string]ctypes.ConfigValue{
+			"compress":          ctypes.ConfigValueBool{Value: true},
+			"compression_level": ctypes.ConfigValueInt{Value: 9},
+		})
+		So(err, ShouldBeNil)
+		So(options.Compress, ShouldBeTrue)
+		So(options.CompressionLevel, ShouldEqual, 9)
+
+		_, err = getClientOptions(map[string]ctypes.ConfigValue{
+			"compression_level": ctypes.ConfigValueInt{Value: 11},
+		})
+		So(err, ShouldNotBeNil)
+
+		invalidRetry := []map[string]ctypes.ConfigValue{
+			{"retry_jitter": ctypes.ConfigValueFloat{Value: 1.5}},
+			{"retry_jitter": ctypes.ConfigValueFloat{Value: -0.1}},
+			{"retry_initial_backoff_ms": ctypes.ConfigValueInt{Value: -1}},
+			{"retry_max_backoff_ms": ctypes.ConfigValueInt{Value: 10}},
+			{"retry_max_attempts": ctypes.ConfigValueInt{Value: -1}},
+		}
+		for _, config := range invalidRetry {
+			_, err = getClientOptions(config)
+			So(err, ShouldNotBeNil)
+		}
+
+		options, err = getClientOptions(map[string]ctypes.ConfigValue{
+			"batch_size":      ctypes.ConfigValueInt{Value: 500},
+			"batch_max_bytes": ctypes.ConfigValueInt{Value: 65536},
+		})
+		So(err, ShouldBeNil)
+		So(options.BatchSize, ShouldEqual, 500)
+		So(options.BatchBytes, ShouldEqual, 65536)
+
+		_, err = getClientOptions(map[string]ctypes.ConfigValue{
+			"batch_size": ctypes.ConfigValueInt{Value: 0},
+		})
+		So(err, ShouldNotBeNil)
+
+		_, err = getClientOptions(map[string]ctypes.ConfigValue{
+			"batch_max_bytes": ctypes.ConfigValueInt{Value: -1},
+		})
+		So(err, ShouldNotBeNil)
+
+		options, err = getClientOptions(map[string]ctypes.ConfigValue{
+			"max_concurrency": ctypes.ConfigValueInt{Value: 4},
+		})
+		So(err, ShouldBeNil)
+		So(options.MaxConcurrency, ShouldEqual, 4)
+
+		_, err = getClientOptions(map[string]ctypes.ConfigValue{
+			"max_concurrency": ctypes.ConfigValueInt{Value: 0},
+		})
+		So(err, ShouldNotBeNil)
+
+		options, err = getClientOptions(map[string]ctypes.ConfigValue{
+			"validate": ctypes.ConfigValueBool{Value: false},
+		})
+		So(err, ShouldBeNil)
+		So(options.Validation, ShouldBeNil)
+
+		_, err = getClientOptions(map[string]ctypes.ConfigValue{
+			"invalid_action": ctypes.ConfigValueStr{Value: "foo"},
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("getSenderOptions", t, func() {
+		options, err := getSenderOptions(map[string]ctypes.ConfigValue{})
+		So(err, ShouldBeNil)
+		So(options, ShouldResemble, defaultSenderOptions())
+
+		options, err = getSenderOptions(map[string]ctypes.ConfigValue{
+			"queue_size":        ctypes.ConfigValueInt{Value: 10},
+			"flush_interval_ms": ctypes.ConfigValueInt{Value: 1000},
+			"flush_size":        ctypes.ConfigValueInt{Value: 5},
+			"drop_policy":       ctypes.ConfigValueStr{Value: "block"},
+		})
+		So(err, ShouldBeNil)
+		So(options, ShouldResemble, senderOptions{10, time.Second, 5, block})
+
+		_, err = getSenderOptions(map[string]ctypes.ConfigValue{
+			"drop_policy": ctypes.ConfigValueStr{Value: "foo"},
+		})
+		So(err, ShouldNotBeNil)
+
+		_, err = getSenderOptions(map[string]ctypes.ConfigValue{
+			"queue_size": ctypes.ConfigValueInt{Value: 0},
+		})
+		So(err, ShouldNotBeNil)
+
+		_, err = getSenderOptions(map[string]ctypes.ConfigValue{
+			"flush_interval_ms": ctypes.ConfigValueInt{Value: 0},
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("getSpoolOptions", t, func() {
+		options, err := getSpoolOptions(map[string]ctypes.ConfigValue{})
+		So(err, ShouldBeNil)
+		So(options, ShouldResemble, DefaultSpoolOptions())
+
+		options, err = getSpoolOptions(map[string]ctypes.ConfigValue{
+			"spool_dir":           ctypes.ConfigValueStr{Value: "/var/spool/{APP}"},
+			"spool_max_bytes":     ctypes.ConfigValueInt{Value: 1000},
+			"spool_max_age_ms":    ctypes.ConfigValueInt{Value: 60000},
+			"spool_segment_bytes": ctypes.ConfigValueInt{Value: 100},
+		})
+		So(err, ShouldBeNil)
+		So(options.Dir, ShouldEqual, "/var/spool/{APP}")
+		So(options.MaxBytes, ShouldEqual, 1000)
+		So(options.MaxAge, ShouldEqual, time.Minute)
+		So(options.SegmentBytes, ShouldEqual, 100)
+
+		invalid := []map[string]ctypes.ConfigValue{
+			{"spool_max_bytes": ctypes.ConfigValueInt{Value: 0}},
+			{"spool_max_bytes": ctypes.ConfigValueInt{Value: -1}},
+			{"spool_segment_bytes": ctypes.ConfigValueInt{Value: 0}},
+			{"spool_segment_bytes": ctypes.ConfigValueInt{Value: -1}},
+			{"spool_max_age_ms": ctypes.ConfigValueInt{Value: -1}},
+		}
+		for _, config := range invalid {
+			_, err = getSpoolOptions(config)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("getSpoolDir", t, func() {
+		env := map[string]string{"APP": "foo"}
+		dir := getSpoolDir("/var/spool/{APP}", "http://foo", env)
+		So(dir, ShouldStartWith, "/var/spool/foo/")
+
+		// Each URI should get a separate directory
+		So(getSpoolDir("/var/spool/{APP}", "http://bar", env), ShouldNotEqual, dir)
+	})
+
+	Convey("getCounterPattern", t, func() {
+		r, err := getCounterPattern(map[string]ctypes.ConfigValue{})
+		So(err, ShouldBeNil)
+		So(r, ShouldBeNil)
+
+		r, err = getCounterPattern(map[string]ctypes.ConfigValue{
+			"counter_pattern": ctypes.ConfigValueStr{Value: "/bytes_.*$"},
+		})
+		So(err, ShouldBeNil)
+		So(r.MatchString("/intel/procfs/iface/eth0/bytes_recv"), ShouldBeTrue)
+
+		_, err = getCounterPattern(map[string]ctypes.ConfigValue{
+			"counter_pattern": ctypes.ConfigValueStr{Value: "(foo"},
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("getDstypeRules", t, func() {
+		rules, err := getDstypeRules(map[string]ctypes.ConfigValue{})
+		So(err, ShouldBeNil)
+		So(rules.dstype("/foo"), ShouldEqual, "gauge")
+
+		rules, err = getDstypeRules(map[string]ctypes.ConfigValue{
+			"dstype_rules":   ctypes.ConfigValueStr{Value: `[{"pattern": "^/foo", "dstype": "rate"}]`},
+			"dstype_default": ctypes.ConfigValueStr{Value: "sum"},
+		})
+		So(err, ShouldBeNil)
+		So(rules.dstype("/foo"), ShouldEqual, "rate")
+		So(rules.dstype("/bar"), ShouldEqual, "sum")
+
+		_, err = getDstypeRules(map[string]ctypes.ConfigValue{
+			"dstype_default": ctypes.ConfigValueStr{Value: "foo"},
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("getAggregationRules", t, func() {
+		rules, err := getAggregationRules(map[string]ctypes.ConfigValue{})
+		So(err, ShouldBeNil)
+		So(rules, ShouldBeEmpty)
+
+		rules, err = getAggregationRules(map[string]ctypes.ConfigValue{
+			"aggregation_rules": ctypes.ConfigValueStr{Value: `[{"pattern": "^foo$", "stat": "sum"}]`},
+		})
+		So(err, ShouldBeNil)
+		So(rules.stat(map[string]string{"name": "foo"}), ShouldEqual, statSum)
+
+		_, err = getAggregationRules(map[string]ctypes.ConfigValue{
+			"aggregation_rules": ctypes.ConfigValueStr{Value: "["},
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("getFilter", t, func() {
+		f, err := getFilter(map[string]ctypes.ConfigValue{})
+		So(err, ShouldBeNil)
+		So(f, ShouldBeNil)
+
+		f, err = getFilter(map[string]ctypes.ConfigValue{
+			"include": ctypes.ConfigValueStr{Value: `["tag:plugin_running_on=~^prod-", "/cpu$"]`},
+			"exclude": ctypes.ConfigValueStr{Value: "/mem$"},
+		})
+		So(err, ShouldBeNil)
+		So(len(f.include), ShouldEqual, 2)
+		So(len(f.exclude), ShouldEqual, 1)
+
+		_, err = getFilter(map[string]ctypes.ConfigValue{
+			"include": ctypes.ConfigValueStr{Value: `["/cpu$", "(bad"]`},
+		})
+		So(err, ShouldNotBeNil)
+
+		_, err = getFilter(map[string]ctypes.ConfigValue{
+			"exclude": ctypes.ConfigValueStr{Value: "(bad"},
+		})
+		So(err.Error(), ShouldStartWith, "exclude: invalid pattern '(bad'")
+	})
+
+	Convey("compileConfig", t, func() {
+		compiled, err := compileConfig(map[string]ctypes.ConfigValue{
+			"exclude":         ctypes.ConfigValueStr{Value: "/mem$"},
+			"counter_pattern": ctypes.ConfigValueStr{Value: "/bytes$"},
+		})
+		So(err, ShouldBeNil)
+		So(compiled.filter, ShouldNotBeNil)
+		So(compiled.counters, ShouldNotBeNil)
+		So(compiled.tagOptions.dstypes.dstype("/foo"), ShouldEqual, "gauge")
+
+		for _, key := range []string{"exclude", "include", "counter_pattern", "dstype_rules", "aggregation_rules", "tag_rules", "name_rules"} {
+			_, err = compileConfig(map[string]ctypes.ConfigValue{
+				key: ctypes.ConfigValueStr{Value: "[(bad"},
+			})
+			So(err, ShouldNotBeNil)
+		}
+
+		// Client, HTTP, spool, and sender settings are checked before any
+		// data is processed
+		invalid := []map[string]ctypes.ConfigValue{
+			{"retry_jitter": ctypes.ConfigValueFloat{Value: 1.5}},
+			{"compression_level": ctypes.ConfigValueInt{Value: 11}},
+			{"batch_size": ctypes.ConfigValueInt{Value: 0}},
+			{"max_concurrency": ctypes.ConfigValueInt{Value: 0}},
+			{"invalid_action": ctypes.ConfigValueStr{Value: "foo"}},
+			{"spool_max_bytes": ctypes.ConfigValueInt{Value: 0}},
+			{"request_timeout_ms": ctypes.ConfigValueInt{Value: 0}},
+			{"queue_size": ctypes.ConfigValueInt{Value: 0}},
+			{"drop_policy": ctypes.ConfigValueStr{Value: "foo"}},
+		}
+		for _, config := range invalid {
+			_, err = compileConfig(config)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("configKey", t, func() {
+		config1 := map[string]ctypes.ConfigValue{
+			"uri":     ctypes.ConfigValueStr{Value: "http://localhost"},
+			"exclude": ctypes.ConfigValueStr{Value: "/foo"},
+		}
+		config2 := map[string]ctypes.ConfigValue{
+			"exclude": ctypes.ConfigValueStr{Value: "/foo"},
+			"uri":     ctypes.ConfigValueStr{Value: "http://localhost"},
+		}
+		config3 := map[string]ctypes.ConfigValue{
+			"exclude": ctypes.ConfigValueStr{Value: "/bar"},
+			"uri":     ctypes.ConfigValueStr{Value: "http://localhost"},
+		}
+		So(configKey(config1), ShouldEqual, configKey(config2))
+		So(configKey(config1), ShouldNotEqual, configKey(config3))
+	})
+
+	Convey("getTagOptions", t, func() {
+		options, err := getTagOptions(map[string]ctypes.ConfigValue{})
+		So(err, ShouldBeNil)
+		So(options.ignored, ShouldResemble, ignoredTags)
+		So(options.mapping, ShouldBeEmpty)
+		So(options.dstypes.dstype("/foo"), ShouldEqual, "gauge")
+
+		options, err = getTagOptions(map[string]ctypes.ConfigValue{
+			"ignore_tags": ctypes.ConfigValueStr{Value: "unit, source,"},
+			"tag_mapping": ctypes.ConfigValueStr{Value: "plugin_running_on=nf.node"},
+		})
+		So(err, ShouldBeNil)
+		So(options.ignored, ShouldResemble, map[string]bool{"unit": true, "source": true})
+		So(options.mapping, ShouldResemble, map[string]string{"plugin_running_on": "nf.node"})
+
+		_, err = getTagOptions(map[string]ctypes.ConfigValue{
+			"tag_mapping": ctypes.ConfigValueStr{Value: "plugin_running_on"},
+		})
+		So(err, ShouldNotBeNil)
+
+		_, err = getTagOptions(map[string]ctypes.ConfigValue{
+			"tag_mapping": ctypes.ConfigValueStr{Value: "plugin_running_on="},
+		})
+		So(err, ShouldNotBeNil)
+
+		_, err = getTagOptions(map[string]ctypes.ConfigValue{
+			"dstype_default": ctypes.ConfigValueStr{Value: "foo"},
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("getValueMapping", t, func() {
+		mapping, err := getValueMapping(map[string]ctypes.ConfigValue{})
+		So(err, ShouldBeNil)
+		So(mapping, ShouldBeEmpty)
+
+		mapping, err = getValueMapping(map[string]ctypes.ConfigValue{
+			"value_mapping": ctypes.ConfigValueStr{Value: "up=1,down=0,degraded=0.5"},
+		})
+		So(err, ShouldBeNil)
+		So(mapping, ShouldResemble, map[string]float64{"up": 1.0, "down": 0.0, "degraded": 0.5})
+
+		_, err = getValueMapping(map[string]ctypes.ConfigValue{
+			"value_mapping": ctypes.ConfigValueStr{Value: "up=yes"},
+		})
+		So(err, ShouldNotBeNil)
+
+		_, err = getValueMapping(map[string]ctypes.ConfigValue{
+			"value_mapping": ctypes.ConfigValueStr{Value: "up"},
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("getValueOptions", t, func() {
+		options, err := getValueOptions(map[string]ctypes.ConfigValue{})
+		So(err, ShouldBeNil)
+		So(options.bits, ShouldBeFalse)
+		So(options.unitTag, ShouldEqual, "")
+
+		options, err = getValueOptions(map[string]ctypes.ConfigValue{
+			"data_unit":     ctypes.ConfigValueStr{Value: "bits"},
+			"unit_tag":      ctypes.ConfigValueStr{Value: "unit"},
+			"value_mapping": ctypes.ConfigValueStr{Value: "up=1"},
+		})
+		So(err, ShouldBeNil)
+		So(options.bits, ShouldBeTrue)
+		So(options.unitTag, ShouldEqual, "unit")
+		So(options.mapping, ShouldResemble, map[string]float64{"up": 1.0})
+
+		_, err = getValueOptions(map[string]ctypes.ConfigValue{
+			"data_unit": ctypes.ConfigValueStr{Value: "nibbles"},
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("getValidationOptions", t, func() {
+		options, err := getValidationOptions(map[string]ctypes.ConfigValue{
+			"max_user_tags":    ctypes.ConfigValueInt{Value: 10},
+			"max_key_length":   ctypes.ConfigValueInt{Value: 20},
+			"max_value_length": ctypes.ConfigValueInt{Value: 30},
+			"max_age_ms":       ctypes.ConfigValueInt{Value: 3600000},
+			"max_future_ms":    ctypes.ConfigValueInt{Value: 60000},
+			"invalid_action":   ctypes.ConfigValueStr{Value: "fix"},
+		})
+		So(err, ShouldBeNil)
+		So(options, ShouldResemble, ValidationOptions{
+			MaxUserTags:    10,
+			MaxKeyLength:   20,
+			MaxValueLength: 30,
+			MaxAge:         time.Hour,
+			MaxFuture:      time.Minute,
+			Fix:            true,
+		})
+
+		_, err = getValidationOptions(map[string]ctypes.ConfigValue{
+			"max_user_tags": ctypes.ConfigValueInt{Value: 0},
+		})
+		So(err, ShouldNotBeNil)
+	})
+}
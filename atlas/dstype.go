@@ -0,0 +1,95 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// Tag used by Atlas to determine how values should be consolidated.
+const dstypeTag = "atlas.dstype"
+
+// Data source types supported by Atlas.
+var dstypes = map[string]bool{
+	"gauge": true,
+	"rate":  true,
+	"sum":   true,
+}
+
+func checkDstype(dstype string) error {
+	if !dstypes[dstype] {
+		return fmt.Errorf("invalid dstype '%s', must be one of gauge, rate, or sum", dstype)
+	}
+	return nil
+}
+
+// Maps metrics matching the namespace pattern to a data source type.
+type dstypeRule struct {
+	pattern *regexp.Regexp
+	dstype  string
+}
+
+// Rules for determining the data source type of a metric. The first rule
+// with a pattern matching the namespace is used. If no rule matches, then the
+// default is used.
+type dstypeRules struct {
+	rules []dstypeRule
+	dflt  string
+}
+
+// Parse the rules from a JSON array of objects with a pattern and dstype,
+// e.g.: [{"pattern": "/bytes_.*$", "dstype": "rate"}]. An empty string means
+// there are no rules and the default will be used for all metrics.
+func parseDstypeRules(s string, dflt string) (*dstypeRules, error) {
+	if err := checkDstype(dflt); err != nil {
+		return nil, err
+	}
+	rules := &dstypeRules{dflt: dflt}
+	if s == "" {
+		return rules, nil
+	}
+
+	var specs []struct {
+		Pattern string `json:"pattern"`
+		Dstype  string `json:"dstype"`
+	}
+	if err := json.Unmarshal([]byte(s), &specs); err != nil {
+		return nil, fmt.Errorf("invalid dstype rules: %v", err)
+	}
+	for _, spec := range specs {
+		r, err := regexp.Compile(spec.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dstype pattern '%s': %v", spec.Pattern, err)
+		}
+		if err := checkDstype(spec.Dstype); err != nil {
+			return nil, err
+		}
+		rules.rules = append(rules.rules, dstypeRule{r, spec.Dstype})
+	}
+	return rules, nil
+}
+
+// Returns the data source type for a namespace.
+func (r *dstypeRules) dstype(namespace string) string {
+	for _, rule := range r.rules {
+		if rule.pattern.MatchString(namespace) {
+			return rule.dstype
+		}
+	}
+	return r.dflt
+}
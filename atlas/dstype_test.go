@@ -0,0 +1,56 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDstype(t *testing.T) {
+
+	Convey("parseDstypeRules", t, func() {
+		rules, err := parseDstypeRules("", "gauge")
+		So(err, ShouldBeNil)
+		So(rules.dstype("/foo"), ShouldEqual, "gauge")
+
+		rules, err = parseDstypeRules(`[
+			{"pattern": "/bytes_.*$", "dstype": "rate"},
+			{"pattern": "/bytes_total$", "dstype": "sum"},
+			{"pattern": "/total$", "dstype": "sum"}
+		]`, "gauge")
+		So(err, ShouldBeNil)
+		So(rules.dstype("/iface/bytes_recv"), ShouldEqual, "rate")
+		So(rules.dstype("/iface/bytes_total"), ShouldEqual, "rate")
+		So(rules.dstype("/iface/total"), ShouldEqual, "sum")
+		So(rules.dstype("/iface/errors"), ShouldEqual, "gauge")
+	})
+
+	Convey("parseDstypeRules invalid", t, func() {
+		_, err := parseDstypeRules("", "counter")
+		So(err, ShouldNotBeNil)
+
+		_, err = parseDstypeRules(`{"pattern": "foo"}`, "gauge")
+		So(err, ShouldNotBeNil)
+
+		_, err = parseDstypeRules(`[{"pattern": "(foo", "dstype": "rate"}]`, "gauge")
+		So(err, ShouldNotBeNil)
+
+		_, err = parseDstypeRules(`[{"pattern": "foo", "dstype": "counter"}]`, "gauge")
+		So(err, ShouldNotBeNil)
+	})
+}
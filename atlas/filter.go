@@ -0,0 +1,110 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+)
+
+// Prefix for a pattern that matches on the value of a tag rather than the
+// namespace, e.g.: tag:plugin_running_on=~prod-.*
+const tagMatcherPrefix = "tag:"
+
+// Matches a metric based on a regex on the namespace or the value of a tag.
+type matcher struct {
+	// Key of the tag to match. If empty, then the namespace is matched.
+	tag string
+
+	pattern *regexp.Regexp
+}
+
+// Parse a single pattern. Patterns of the form tag:<key>=~<regex> match the
+// value of the tag, anything else is a regex on the namespace.
+func parseMatcher(s string) (*matcher, error) {
+	if !strings.HasPrefix(s, tagMatcherPrefix) {
+		r, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %v", s, err)
+		}
+		return &matcher{pattern: r}, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(s, tagMatcherPrefix), "=~", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid pattern '%s', tag patterns must have the form tag:<key>=~<regex>", s)
+	}
+	r, err := regexp.Compile(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s': %v", s, err)
+	}
+	return &matcher{tag: parts[0], pattern: r}, nil
+}
+
+// Split a config value into the list of patterns. The value can either be a
+// JSON array of strings or a single pattern. Since a regex can also start
+// with '[', for example a character class, the value is treated as a single
+// pattern if it cannot be decoded as a JSON array.
+func splitPatterns(s string) []string {
+	if s == "" {
+		return nil
+	}
+	if strings.HasPrefix(strings.TrimSpace(s), "[") {
+		var patterns []string
+		if err := json.Unmarshal([]byte(s), &patterns); err == nil {
+			return patterns
+		}
+	}
+	return []string{s}
+}
+
+// Returns true if the metric matches the pattern. If the tag is not present,
+// then it will not match.
+func (m *matcher) matches(metric plugin.MetricType) bool {
+	if m.tag == "" {
+		return m.pattern.MatchString(metric.Namespace().String())
+	}
+	v, ok := metric.Tags()[m.tag]
+	return ok && m.pattern.MatchString(v)
+}
+
+func matchesAny(matchers []*matcher, metric plugin.MetricType) bool {
+	for _, m := range matchers {
+		if m.matches(metric) {
+			return true
+		}
+	}
+	return false
+}
+
+// Determines which metrics will be sent to Atlas. A metric that matches any
+// of the exclude patterns is always dropped. Otherwise, if there are include
+// patterns, then the metric must match at least one of them.
+type metricFilter struct {
+	include []*matcher
+	exclude []*matcher
+}
+
+func (f *metricFilter) keep(metric plugin.MetricType) bool {
+	if matchesAny(f.exclude, metric) {
+		return false
+	}
+	return len(f.include) == 0 || matchesAny(f.include, metric)
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core"
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFilter(t *testing.T) {
+
+	timestamp := time.Now()
+	newMetric := func(host string, ns ...string) plugin.MetricType {
+		return *plugin.NewMetricType(core.NewNamespace(ns...), timestamp, map[string]string{"plugin_running_on": host}, "", 1)
+	}
+
+	Convey("parseMatcher", t, func() {
+		m, err := parseMatcher("^/foo")
+		So(err, ShouldBeNil)
+		So(m.tag, ShouldEqual, "")
+		So(m.matches(newMetric("prod-1", "foo", "bar")), ShouldBeTrue)
+		So(m.matches(newMetric("prod-1", "bar", "foo")), ShouldBeFalse)
+
+		m, err = parseMatcher("tag:plugin_running_on=~^prod-.*")
+		So(err, ShouldBeNil)
+		So(m.tag, ShouldEqual, "plugin_running_on")
+		So(m.matches(newMetric("prod-1", "foo")), ShouldBeTrue)
+		So(m.matches(newMetric("test-1", "foo")), ShouldBeFalse)
+
+		// Missing tag does not match
+		m, _ = parseMatcher("tag:nf.app=~.*")
+		So(m.matches(newMetric("prod-1", "foo")), ShouldBeFalse)
+
+		_, err = parseMatcher("(foo")
+		So(err, ShouldNotBeNil)
+		_, err = parseMatcher("tag:foo=bar")
+		So(err, ShouldNotBeNil)
+		_, err = parseMatcher("tag:=~bar")
+		So(err, ShouldNotBeNil)
+		_, err = parseMatcher("tag:foo=~(bar")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("splitPatterns", t, func() {
+		So(splitPatterns(""), ShouldBeEmpty)
+		So(splitPatterns("/foo,bar"), ShouldResemble, []string{"/foo,bar"})
+		So(splitPatterns(`["/foo", "tag:a=~b"]`), ShouldResemble, []string{"/foo", "tag:a=~b"})
+
+		// Values that are not a JSON list are treated as a single pattern
+		So(splitPatterns(`["/foo"`), ShouldResemble, []string{`["/foo"`})
+		So(splitPatterns("[/]intel/.*"), ShouldResemble, []string{"[/]intel/.*"})
+		So(splitPatterns("[a-z]+/cpu"), ShouldResemble, []string{"[a-z]+/cpu"})
+	})
+
+	Convey("character class pattern", t, func() {
+		f, err := getFilter(map[string]ctypes.ConfigValue{
+			"exclude": ctypes.ConfigValueStr{Value: "[/]intel/.*"},
+		})
+		So(err, ShouldBeNil)
+		So(f.keep(newMetric("prod-1", "intel", "cpu")), ShouldBeFalse)
+		So(f.keep(newMetric("prod-1", "other", "cpu")), ShouldBeTrue)
+
+		_, err = getFilter(map[string]ctypes.ConfigValue{
+			"exclude": ctypes.ConfigValueStr{Value: `["/foo"`},
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("metricFilter precedence", t, func() {
+		input := []plugin.MetricType{
+			newMetric("prod-1", "intel", "cpu"),
+			newMetric("prod-1", "intel", "mem"),
+			newMetric("test-1", "intel", "cpu"),
+			newMetric("prod-2", "intel", "disk"),
+		}
+
+		include1, _ := parseMatcher("tag:plugin_running_on=~^prod-")
+		include2, _ := parseMatcher("/cpu$")
+		exclude, _ := parseMatcher("/mem$")
+
+		// Include only
+		f := &metricFilter{include: []*matcher{include1}}
+		So(filterMetrics(input, f), ShouldResemble, []plugin.MetricType{input[0], input[1], input[3]})
+
+		// Multiple includes match any
+		f = &metricFilter{include: []*matcher{include1, include2}}
+		So(filterMetrics(input, f), ShouldResemble, input)
+
+		// Exclude wins over include
+		f = &metricFilter{include: []*matcher{include1}, exclude: []*matcher{exclude}}
+		So(filterMetrics(input, f), ShouldResemble, []plugin.MetricType{input[0], input[3]})
+	})
+}
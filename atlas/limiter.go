@@ -0,0 +1,78 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import "sync"
+
+// Limits the number of requests that can be in flight at the same time. A
+// limiter can be shared by multiple clients so that the limit applies across
+// all calls to Publish for a URI.
+type RequestLimiter struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	size   int
+	active int
+}
+
+// Create a new limiter that allows up to n concurrent requests. If n is less
+// than 1, then a limit of 1 will be used.
+func NewRequestLimiter(n int) *RequestLimiter {
+	if n < 1 {
+		n = 1
+	}
+	l := &RequestLimiter{size: n}
+	l.cond = sync.NewCond(&l.mutex)
+	return l
+}
+
+// Maximum number of concurrent requests.
+func (l *RequestLimiter) Size() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.size
+}
+
+// Change the maximum number of concurrent requests. Requests that are already
+// in flight keep their slots, so if the size is reduced new requests will
+// wait until the number in flight is below the new limit. If n is less than
+// 1, then a limit of 1 will be used.
+func (l *RequestLimiter) resize(n int) {
+	if n < 1 {
+		n = 1
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.size = n
+	l.cond.Broadcast()
+}
+
+// Block until a slot is available.
+func (l *RequestLimiter) acquire() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for l.active >= l.size {
+		l.cond.Wait()
+	}
+	l.active++
+}
+
+// Release a slot that was previously acquired.
+func (l *RequestLimiter) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.active--
+	l.cond.Signal()
+}
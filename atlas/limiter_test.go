@@ -0,0 +1,92 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRequestLimiter(t *testing.T) {
+
+	Convey("size", t, func() {
+		So(NewRequestLimiter(4).Size(), ShouldEqual, 4)
+		So(NewRequestLimiter(0).Size(), ShouldEqual, 1)
+		So(NewRequestLimiter(-1).Size(), ShouldEqual, 1)
+	})
+
+	Convey("bounds concurrent holders", t, func() {
+		limiter := NewRequestLimiter(3)
+
+		var active, maxActive int32
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				limiter.acquire()
+				defer limiter.release()
+
+				n := atomic.AddInt32(&active, 1)
+				for {
+					m := atomic.LoadInt32(&maxActive)
+					if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&active, -1)
+			}()
+		}
+		wg.Wait()
+		So(maxActive, ShouldBeLessThanOrEqualTo, 3)
+		So(maxActive, ShouldBeGreaterThan, 0)
+	})
+
+	Convey("resize", t, func() {
+		limiter := NewRequestLimiter(1)
+		limiter.acquire()
+
+		// Waiting request is unblocked when the size is increased
+		acquired := make(chan bool)
+		go func() {
+			limiter.acquire()
+			acquired <- true
+		}()
+		early := false
+		select {
+		case <-acquired:
+			early = true
+		case <-time.After(10 * time.Millisecond):
+		}
+		So(early, ShouldBeFalse)
+		limiter.resize(2)
+		<-acquired
+		So(limiter.Size(), ShouldEqual, 2)
+
+		// Slots already held are kept when the size is reduced
+		limiter.resize(0)
+		So(limiter.Size(), ShouldEqual, 1)
+		limiter.release()
+		limiter.release()
+		limiter.acquire()
+		limiter.release()
+	})
+}
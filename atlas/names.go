@@ -0,0 +1,109 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// Rule for naming metrics with a namespace matching the pattern. The name and
+// tag values are templates that can use the same variables as the tags on a
+// metric, e.g.: {namespace}, {0}, {-1}, or the name of a dynamic element.
+// Named capture groups in the pattern are also available as variables. The
+// templates are parsed when the rules are created. The name will be nil if
+// the rule only adds tags.
+type nameRule struct {
+	pattern *regexp.Regexp
+	name    *template
+	tags    map[string]*template
+}
+
+// Ordered list of naming rules. The first rule with a pattern matching the
+// namespace is used.
+type nameRules []nameRule
+
+// Parse the rules from a JSON array of objects with a pattern on the
+// namespace, a name template, and optionally a map of tag templates, e.g.:
+//
+//	[
+//	  {
+//	    "pattern": "^/intel/procfs/iface/(?P<iface>[^/]+)/",
+//	    "name": "net.{-1}",
+//	    "tags": {"iface": "{iface}"}
+//	  }
+//	]
+//
+// If the name is empty, then only the tags will be added.
+func parseNameRules(s string) (nameRules, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var specs []struct {
+		Pattern string            `json:"pattern"`
+		Name    string            `json:"name"`
+		Tags    map[string]string `json:"tags"`
+	}
+	if err := json.Unmarshal([]byte(s), &specs); err != nil {
+		return nil, fmt.Errorf("invalid name rules: %v", err)
+	}
+
+	var rules nameRules
+	for _, spec := range specs {
+		r, err := regexp.Compile(spec.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name rule pattern '%s': %v", spec.Pattern, err)
+		}
+		if spec.Name == "" && len(spec.Tags) == 0 {
+			return nil, fmt.Errorf("name rule for '%s' must have a name or tags", spec.Pattern)
+		}
+		rule := nameRule{pattern: r, tags: make(map[string]*template, len(spec.Tags))}
+		if spec.Name != "" {
+			if rule.name, err = parseTemplate(spec.Name); err != nil {
+				return nil, fmt.Errorf("invalid name template for '%s': %v", spec.Pattern, err)
+			}
+		}
+		for k, v := range spec.Tags {
+			if rule.tags[k], err = parseTemplate(v); err != nil {
+				return nil, fmt.Errorf("invalid template for tag '%s' for '%s': %v", k, spec.Pattern, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Find the first rule matching the namespace. The values of named capture
+// groups in the pattern are added to the vars. Returns nil if no rule
+// matches.
+func (r nameRules) match(namespace string, vars map[string]string) *nameRule {
+	for i := range r {
+		rule := &r[i]
+		groups := rule.pattern.FindStringSubmatch(namespace)
+		if groups == nil {
+			continue
+		}
+		for j, name := range rule.pattern.SubexpNames() {
+			if name != "" {
+				vars[name] = groups[j]
+			}
+		}
+		return rule
+	}
+	return nil
+}
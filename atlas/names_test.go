@@ -0,0 +1,111 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"testing"
+
+	"github.com/intelsdi-x/snap/core"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNames(t *testing.T) {
+
+	Convey("parseNameRules", t, func() {
+		rules, err := parseNameRules("")
+		So(err, ShouldBeNil)
+		So(rules, ShouldBeEmpty)
+
+		rules, err = parseNameRules(`[
+			{"pattern": "^/intel/procfs/iface/", "name": "net.{-1}"},
+			{"pattern": "^/intel/", "tags": {"source": "intel"}}
+		]`)
+		So(err, ShouldBeNil)
+		So(len(rules), ShouldEqual, 2)
+		vars := map[string]string{"-1": "eth0"}
+		name, _ := rules[0].name.expand(vars, true)
+		So(name, ShouldEqual, "net.eth0")
+		So(rules[1].name, ShouldBeNil)
+		source, _ := rules[1].tags["source"].expand(vars, true)
+		So(source, ShouldEqual, "intel")
+
+		_, err = parseNameRules(`[{"pattern": "(foo", "name": "foo"}]`)
+		So(err, ShouldNotBeNil)
+		_, err = parseNameRules(`[{"pattern": "foo"}]`)
+		So(err, ShouldNotBeNil)
+		_, err = parseNameRules(`{"pattern": "foo", "name": "foo"}`)
+		So(err, ShouldNotBeNil)
+		_, err = parseNameRules(`[{"pattern": "foo", "name": "{foo"}]`)
+		So(err, ShouldNotBeNil)
+		_, err = parseNameRules(`[{"pattern": "foo", "tags": {"id": "{1|foo}"}}]`)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("match", t, func() {
+		rules, _ := parseNameRules(`[
+			{"pattern": "^/intel/procfs/iface/(?P<iface>[^/]+)/", "name": "net.{-1}"},
+			{"pattern": "^/intel/", "name": "{namespace}"}
+		]`)
+
+		vars := map[string]string{}
+		rule := rules.match("/intel/procfs/iface/eth0/bytes_recv", vars)
+		So(rule, ShouldEqual, &rules[0])
+		So(vars, ShouldResemble, map[string]string{"iface": "eth0"})
+
+		rule = rules.match("/intel/procfs/cpu/user", vars)
+		So(rule, ShouldEqual, &rules[1])
+
+		So(rules.match("/foo", vars), ShouldBeNil)
+	})
+
+	Convey("createAtlasTags with name rules", t, func() {
+		rules, _ := parseNameRules(`[
+			{
+				"pattern": "^/intel/procfs/iface/(?P<iface>[^/]+)/",
+				"name": "net.{-1}",
+				"tags": {"iface": "{iface}", "source": "{1}"}
+			}
+		]`)
+		options := &tagOptions{ignored: ignoredTags, names: rules}
+
+		ns := core.NewNamespace("intel", "procfs", "iface", "eth0", "bytes_recv")
+		actual, err := createAtlasTags(ns, map[string]string{}, options)
+		So(err, ShouldBeNil)
+		So(actual, ShouldResemble, map[string]string{
+			"name":   "net.bytes_recv",
+			"iface":  "eth0",
+			"source": "procfs",
+		})
+
+		// Tags on the metric take precedence
+		actual, err = createAtlasTags(ns, map[string]string{"name": "custom", "source": "snap"}, options)
+		So(err, ShouldBeNil)
+		So(actual, ShouldResemble, map[string]string{
+			"name":   "custom",
+			"iface":  "eth0",
+			"source": "snap",
+		})
+
+		// No matching rule
+		ns = core.NewNamespace("intel", "procfs", "cpu")
+		actual, err = createAtlasTags(ns, map[string]string{}, options)
+		So(err, ShouldBeNil)
+		So(actual, ShouldResemble, map[string]string{
+			"name": "intel.procfs.cpu",
+		})
+	})
+}
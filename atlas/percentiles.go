@@ -0,0 +1,279 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+)
+
+// Upper bounds for the percentile buckets used by Spectator. There are 276
+// buckets with the width increasing exponentially in powers of 4 and each
+// power of 4 subdivided linearly. Using the same buckets allows the data to
+// be used with the :percentiles operator in Atlas.
+var percentileBuckets = newPercentileBuckets()
+
+func newPercentileBuckets() []int64 {
+	buckets := []int64{1, 2, 3}
+	for exp := uint(2); exp < 64; exp += 2 {
+		current := int64(1) << exp
+		delta := current / 3
+		next := (current << 2) - delta
+		for current < next {
+			buckets = append(buckets, current)
+			current += delta
+		}
+	}
+	return append(buckets, math.MaxInt64)
+}
+
+// Returns the index of the bucket for a value.
+func percentileIndex(v int64) int {
+	if v <= 0 {
+		return 0
+	}
+	return sort.Search(len(percentileBuckets), func(i int) bool {
+		return percentileBuckets[i] >= v
+	})
+}
+
+// Measurements for a timer or distribution summary that will be expanded to
+// a set of Atlas series.
+type distribution struct {
+	count   float64
+	total   float64
+	max     float64
+	buckets map[int]float64
+
+	hasTotal bool
+	hasMax   bool
+}
+
+func newDistribution() *distribution {
+	return &distribution{buckets: make(map[int]float64)}
+}
+
+// Record a count for a value. For timers the value should be in seconds.
+func (d *distribution) record(v float64, count float64, timer bool) {
+	if timer {
+		v *= 1e9
+	}
+	i := len(percentileBuckets) - 1
+	if v < math.MaxInt64 {
+		i = percentileIndex(int64(math.Ceil(v)))
+	}
+	d.buckets[i] += count
+}
+
+// Returns true if the value of a metric should be treated as a distribution.
+func isDistribution(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	switch reflect.TypeOf(v).Kind() {
+	case reflect.Slice, reflect.Array:
+		_, isBytes := v.([]byte)
+		return !isBytes
+	case reflect.Map:
+		return true
+	default:
+		return false
+	}
+}
+
+// Convert the value of a metric to a distribution. The value can be either:
+//
+// 1. A slice of individual measurements.
+// 2. A map with the summary statistics and bucket counts, e.g.:
+//
+//	{"count": 5, "totalTime": 1.2, "max": 0.7, "buckets": {"0.1": 2, "0.5": 2, "1.0": 1}}
+//
+// All keys are optional. The total can also be specified as "sum" or
+// "totalAmount". Each bucket is keyed by the upper bound and the count will
+// be recorded in the Spectator bucket containing that bound. The values are
+// converted to the base unit using the unit of the metric.
+func toDistribution(v interface{}, u unit) (*distribution, error) {
+	d := newDistribution()
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			n, err := toNumber(value.Index(i).Interface(), nil)
+			if err != nil {
+				return nil, err
+			}
+			n = u.convert(n)
+			d.count++
+			d.total += n
+			if !d.hasMax || n > d.max {
+				d.max = n
+			}
+			d.hasTotal = true
+			d.hasMax = true
+			d.record(n, 1.0, u.time)
+		}
+		return d, nil
+	case reflect.Map:
+		return toDistributionFromMap(value, u)
+	default:
+		return nil, &nonNumericError{v}
+	}
+}
+
+func toDistributionFromMap(value reflect.Value, u unit) (*distribution, error) {
+	d := newDistribution()
+	hasCount := false
+	bucketCount := 0.0
+	bucketMax := math.NaN()
+	for _, key := range value.MapKeys() {
+		k := fmt.Sprintf("%v", key.Interface())
+		v := value.MapIndex(key).Interface()
+		if k == "buckets" {
+			if !isDistribution(v) || reflect.TypeOf(v).Kind() != reflect.Map {
+				return nil, fmt.Errorf("buckets must be a map of upper bound to count")
+			}
+			buckets := reflect.ValueOf(v)
+			for _, b := range buckets.MapKeys() {
+				bound, err := strconv.ParseFloat(fmt.Sprintf("%v", b.Interface()), 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid bucket bound '%v'", b.Interface())
+				}
+				count, err := toNumber(buckets.MapIndex(b).Interface(), nil)
+				if err != nil {
+					return nil, err
+				}
+				if count <= 0 {
+					continue
+				}
+				bound = u.convert(bound)
+				d.record(bound, count, u.time)
+				bucketCount += count
+				if math.IsNaN(bucketMax) || bound > bucketMax {
+					bucketMax = bound
+				}
+			}
+			continue
+		}
+
+		n, err := toNumber(v, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for '%s': %v", k, err)
+		}
+		switch k {
+		case "count":
+			d.count = n
+			hasCount = true
+		case "totalTime", "totalAmount", "sum":
+			d.total = u.convert(n)
+			d.hasTotal = true
+		case "max":
+			d.max = u.convert(n)
+			d.hasMax = true
+		default:
+			return nil, fmt.Errorf("unknown key '%s'", k)
+		}
+	}
+
+	// Fill in from the buckets if not explicitly specified. The max will be
+	// the upper bound of the largest bucket so it may be an overestimate.
+	if !hasCount {
+		d.count = bucketCount
+	}
+	if !d.hasMax && !math.IsNaN(bucketMax) && !math.IsInf(bucketMax, 1) {
+		d.max = bucketMax
+		d.hasMax = true
+	}
+	return d, nil
+}
+
+// Expand a distribution into the Atlas series following the Spectator
+// conventions for percentile timers and distribution summaries. The base tags
+// are copied for each series with the statistic tag set. The count, total, and
+// percentile series are tagged as sums so the values must be the deltas for
+// the interval. Cumulative values need to be converted to a rate by the
+// caller.
+func (d *distribution) toMetrics(tags map[string]string, timestamp uint64, timer bool) []Metric {
+	newTags := func(statistic string) map[string]string {
+		copy := make(map[string]string, len(tags)+2)
+		for k, v := range tags {
+			copy[k] = v
+		}
+		copy["statistic"] = statistic
+		copy[dstypeTag] = "sum"
+		return copy
+	}
+
+	totalStat := "totalAmount"
+	prefix := "D"
+	if timer {
+		totalStat = "totalTime"
+		prefix = "T"
+	}
+
+	metrics := []Metric{Metric{newTags("count"), timestamp, d.count}}
+	if d.hasTotal {
+		metrics = append(metrics, Metric{newTags(totalStat), timestamp, d.total})
+	}
+	if d.hasMax {
+		maxTags := newTags("max")
+		maxTags[dstypeTag] = "gauge"
+		metrics = append(metrics, Metric{maxTags, timestamp, d.max})
+	}
+
+	indexes := make([]int, 0, len(d.buckets))
+	for i := range d.buckets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		pctTags := newTags("percentile")
+		pctTags["percentile"] = fmt.Sprintf("%s%04X", prefix, i)
+		metrics = append(metrics, Metric{pctTags, timestamp, d.buckets[i]})
+	}
+	return metrics
+}
+
+// Convert a metric with a distribution value to the set of Atlas series. If
+// the unit is a time unit, then it will be treated as a percentile timer.
+// Otherwise, it will be treated as a percentile distribution summary.
+func toDistributionMetrics(metric plugin.MetricType, options *tagOptions, values *valueOptions) ([]Metric, error) {
+	if values == nil {
+		values = defaultValueOptions
+	}
+	tags, err := createAtlasTags(metric.Namespace(), metric.Tags(), options)
+	if err != nil {
+		return nil, err
+	}
+
+	u, ok := parseUnit(metricUnit(metric), values.bits)
+	if !ok {
+		u = newUnit(1, "")
+	}
+	if values.unitTag != "" && u.name != "" {
+		tags[values.unitTag] = u.name
+	}
+
+	d, err := toDistribution(metric.Data(), u)
+	if err != nil {
+		return nil, err
+	}
+	return d.toMetrics(tags, uint64(metric.Timestamp().Unix()*1000), u.time), nil
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPercentiles(t *testing.T) {
+
+	ms, _ := parseUnit("ms", false)
+	none, _ := parseUnit("", false)
+
+	Convey("percentileBuckets", t, func() {
+		So(len(percentileBuckets), ShouldEqual, 276)
+		So(percentileBuckets[:16], ShouldResemble, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 16, 21})
+		So(percentileBuckets[len(percentileBuckets)-1], ShouldEqual, int64(math.MaxInt64))
+		for i := 1; i < len(percentileBuckets); i++ {
+			So(percentileBuckets[i], ShouldBeGreaterThan, percentileBuckets[i-1])
+		}
+	})
+
+	Convey("percentileIndex", t, func() {
+		So(percentileIndex(-1), ShouldEqual, 0)
+		So(percentileIndex(0), ShouldEqual, 0)
+		So(percentileIndex(1), ShouldEqual, 0)
+		So(percentileIndex(4), ShouldEqual, 3)
+		So(percentileIndex(15), ShouldEqual, 14)
+		So(percentileIndex(16), ShouldEqual, 14)
+		So(percentileIndex(17), ShouldEqual, 15)
+		So(percentileIndex(1000000), ShouldEqual, 0x56)
+		So(percentileIndex(1000000000), ShouldEqual, 0x83)
+		So(percentileIndex(math.MaxInt64), ShouldEqual, 275)
+	})
+
+	Convey("isDistribution", t, func() {
+		So(isDistribution([]float64{1.0}), ShouldBeTrue)
+		So(isDistribution([]interface{}{}), ShouldBeTrue)
+		So(isDistribution(map[string]interface{}{}), ShouldBeTrue)
+		So(isDistribution([]byte("foo")), ShouldBeFalse)
+		So(isDistribution(1.0), ShouldBeFalse)
+		So(isDistribution("foo"), ShouldBeFalse)
+		So(isDistribution(nil), ShouldBeFalse)
+	})
+
+	Convey("timer from measurements", t, func() {
+		d, err := toDistribution([]int{1, 2, 3, 2}, ms)
+		So(err, ShouldBeNil)
+		So(d.toMetrics(map[string]string{"name": "latency"}, 1000, true), ShouldResemble, []Metric{
+			Metric{map[string]string{"name": "latency", "statistic": "count", "atlas.dstype": "sum"}, 1000, 4.0},
+			Metric{map[string]string{"name": "latency", "statistic": "totalTime", "atlas.dstype": "sum"}, 1000, 0.008},
+			Metric{map[string]string{"name": "latency", "statistic": "max", "atlas.dstype": "gauge"}, 1000, 0.003},
+			Metric{map[string]string{"name": "latency", "statistic": "percentile", "percentile": "T0056", "atlas.dstype": "sum"}, 1000, 1.0},
+			Metric{map[string]string{"name": "latency", "statistic": "percentile", "percentile": "T0059", "atlas.dstype": "sum"}, 1000, 2.0},
+			Metric{map[string]string{"name": "latency", "statistic": "percentile", "percentile": "T005C", "atlas.dstype": "sum"}, 1000, 1.0},
+		})
+
+		_, err = toDistribution([]interface{}{1.0, "foo"}, ms)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("distribution summary from buckets", t, func() {
+		var value map[string]interface{}
+		json.Unmarshal([]byte(`{"count": 7, "buckets": {"100": 2, "500": 4, "1000": 0, "+Inf": 1}}`), &value)
+		d, err := toDistribution(value, none)
+		So(err, ShouldBeNil)
+		So(d.toMetrics(map[string]string{"name": "size"}, 1000, false), ShouldResemble, []Metric{
+			Metric{map[string]string{"name": "size", "statistic": "count", "atlas.dstype": "sum"}, 1000, 7.0},
+			Metric{map[string]string{"name": "size", "statistic": "percentile", "percentile": "D0019", "atlas.dstype": "sum"}, 1000, 2.0},
+			Metric{map[string]string{"name": "size", "statistic": "percentile", "percentile": "D0023", "atlas.dstype": "sum"}, 1000, 4.0},
+			Metric{map[string]string{"name": "size", "statistic": "percentile", "percentile": "D0113", "atlas.dstype": "sum"}, 1000, 1.0},
+		})
+	})
+
+	Convey("timer from summary", t, func() {
+		d, err := toDistribution(map[string]float64{"count": 10, "totalTime": 2000, "max": 500}, ms)
+		So(err, ShouldBeNil)
+		So(d.toMetrics(map[string]string{"name": "latency"}, 1000, true), ShouldResemble, []Metric{
+			Metric{map[string]string{"name": "latency", "statistic": "count", "atlas.dstype": "sum"}, 1000, 10.0},
+			Metric{map[string]string{"name": "latency", "statistic": "totalTime", "atlas.dstype": "sum"}, 1000, 2.0},
+			Metric{map[string]string{"name": "latency", "statistic": "max", "atlas.dstype": "gauge"}, 1000, 0.5},
+		})
+
+		// Max and count are computed from the buckets if not specified
+		d, err = toDistribution(map[string]interface{}{
+			"buckets": map[string]int{"100": 1, "1000": 2},
+		}, ms)
+		So(err, ShouldBeNil)
+		So(d.count, ShouldEqual, 3.0)
+		So(d.max, ShouldEqual, 1.0)
+		So(d.hasTotal, ShouldBeFalse)
+		So(d.buckets, ShouldResemble, map[int]float64{0x73: 1.0, 0x83: 2.0})
+	})
+
+	Convey("invalid distributions", t, func() {
+		invalid := []interface{}{
+			map[string]interface{}{"foo": 1},
+			map[string]interface{}{"count": "foo"},
+			map[string]interface{}{"buckets": 1},
+			map[string]interface{}{"buckets": map[string]interface{}{"foo": 1}},
+			map[string]interface{}{"buckets": map[string]interface{}{"1": "foo"}},
+		}
+		for _, v := range invalid {
+			_, err := toDistribution(v, none)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("converter expands distributions", t, func() {
+		var value []interface{}
+		json.Unmarshal([]byte(`[1, 1]`), &value)
+		input := []plugin.MetricType{
+			*plugin.NewMetricType(core.NewNamespace("foo"), time.Unix(1, 0), map[string]string{"unit": "s"}, "", value),
+		}
+		conv := &converter{}
+		So(conv.toAtlasMetrics(input), ShouldResemble, []Metric{
+			Metric{map[string]string{"name": "foo", "statistic": "count", "atlas.dstype": "sum"}, 1000, 2.0},
+			Metric{map[string]string{"name": "foo", "statistic": "totalTime", "atlas.dstype": "sum"}, 1000, 2.0},
+			Metric{map[string]string{"name": "foo", "statistic": "max", "atlas.dstype": "gauge"}, 1000, 1.0},
+			Metric{map[string]string{"name": "foo", "statistic": "percentile", "percentile": "T0083", "atlas.dstype": "sum"}, 1000, 2.0},
+		})
+	})
+
+	Convey("converter with cumulative distributions", t, func() {
+		conv := &converter{rates: newRateTracker()}
+		tags := map[string]string{"type": "counter"}
+		sample := func(ts int64, data string) []plugin.MetricType {
+			var value map[string]interface{}
+			json.Unmarshal([]byte(data), &value)
+			return []plugin.MetricType{
+				*plugin.NewMetricType(core.NewNamespace("foo"), time.Unix(ts, 0), tags, "", value),
+			}
+		}
+
+		// First sample only has the max
+		So(conv.toAtlasMetrics(sample(1000, `{"count": 10, "sum": 100, "max": 20, "buckets": {"3": 10}}`)), ShouldResemble, []Metric{
+			Metric{map[string]string{"name": "foo", "type": "counter", "statistic": "max", "atlas.dstype": "gauge"}, 1000000, 20.0},
+		})
+
+		So(conv.toAtlasMetrics(sample(1060, `{"count": 70, "sum": 400, "max": 30, "buckets": {"3": 40, "4": 30}}`)), ShouldResemble, []Metric{
+			Metric{map[string]string{"name": "foo", "type": "counter", "statistic": "count", "atlas.dstype": "rate"}, 1060000, 1.0},
+			Metric{map[string]string{"name": "foo", "type": "counter", "statistic": "totalAmount", "atlas.dstype": "rate"}, 1060000, 5.0},
+			Metric{map[string]string{"name": "foo", "type": "counter", "statistic": "max", "atlas.dstype": "gauge"}, 1060000, 30.0},
+			Metric{map[string]string{"name": "foo", "type": "counter", "statistic": "percentile", "percentile": "D0002", "atlas.dstype": "rate"}, 1060000, 0.5},
+		})
+	})
+}
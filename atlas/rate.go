@@ -0,0 +1,127 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long to keep the previous sample for a counter that has not been
+// updated. This prevents the state from growing without bound as series
+// come and go.
+const counterStateTTL = 15 * time.Minute
+
+// Create a string key that uniquely identifies a tag map.
+func tagsKey(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buffer bytes.Buffer
+	for _, k := range keys {
+		buffer.WriteString(k)
+		buffer.WriteByte('=')
+		buffer.WriteString(tags[k])
+		buffer.WriteByte(',')
+	}
+	return buffer.String()
+}
+
+type counterSample struct {
+	timestamp uint64
+	value     float64
+}
+
+// Tracks the previous sample for monotonically increasing counters so they
+// can be converted to a per-second rate.
+type rateTracker struct {
+	mutex    sync.Mutex
+	previous map[string]counterSample
+}
+
+func newRateTracker() *rateTracker {
+	return &rateTracker{previous: make(map[string]counterSample)}
+}
+
+// Compute the increase between two counter samples. If the current value is
+// less than the previous value, then it is treated as a wrap if the previous
+// value was close to the max for a 32-bit or 64-bit counter. Otherwise, it is
+// treated as a reset and false is returned.
+func counterDelta(previous, current float64) (float64, bool) {
+	if current >= previous {
+		return current - previous, true
+	}
+
+	for _, max := range []float64{math.MaxUint32 + 1.0, math.MaxUint64 + 1.0} {
+		if previous < max {
+			delta := max - previous + current
+			if delta < max/2 {
+				return delta, true
+			}
+			return 0.0, false
+		}
+	}
+	return 0.0, false
+}
+
+// Update the state for the counter and compute the per-second rate since
+// the previous sample. Returns false if there is no rate for this sample
+// because it is the first one for the series, the counter was reset, or the
+// timestamp did not move forward. Samples that are not newer than the
+// previous sample are ignored and do not update the state.
+func (t *rateTracker) rate(m Metric) (float64, bool) {
+	key := tagsKey(m.Tags)
+	sample := counterSample{m.Timestamp, m.Value}
+
+	t.mutex.Lock()
+	previous, ok := t.previous[key]
+	if ok && sample.timestamp <= previous.timestamp {
+		t.mutex.Unlock()
+		return 0.0, false
+	}
+	t.previous[key] = sample
+	t.mutex.Unlock()
+
+	if !ok {
+		return 0.0, false
+	}
+
+	delta, ok := counterDelta(previous.value, sample.value)
+	if !ok {
+		return 0.0, false
+	}
+	seconds := float64(sample.timestamp-previous.timestamp) / 1000.0
+	return delta / seconds, true
+}
+
+// Remove the state for counters that have not been updated recently.
+func (t *rateTracker) expire(now time.Time) {
+	cutoff := uint64(now.Add(-counterStateTTL).Unix() * 1000)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for k, sample := range t.previous {
+		if sample.timestamp < cutoff {
+			delete(t.previous, k)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"math"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRate(t *testing.T) {
+
+	Convey("tagsKey", t, func() {
+		So(tagsKey(map[string]string{}), ShouldEqual, "")
+		So(tagsKey(map[string]string{"b": "2", "a": "1"}), ShouldEqual, "a=1,b=2,")
+		So(tagsKey(map[string]string{"a": "1", "b": "2"}), ShouldEqual, tagsKey(map[string]string{"b": "2", "a": "1"}))
+	})
+
+	Convey("counterDelta", t, func() {
+		delta, ok := counterDelta(10.0, 15.0)
+		So(ok, ShouldBeTrue)
+		So(delta, ShouldEqual, 5.0)
+
+		// 32-bit wrap
+		delta, ok = counterDelta(math.MaxUint32-4.0, 5.0)
+		So(ok, ShouldBeTrue)
+		So(delta, ShouldEqual, 10.0)
+
+		// 64-bit wrap
+		delta, ok = counterDelta(math.Pow(2, 64)-4096.0, 2048.0)
+		So(ok, ShouldBeTrue)
+		So(delta, ShouldEqual, 6144.0)
+
+		// Reset
+		_, ok = counterDelta(1000.0, 10.0)
+		So(ok, ShouldBeFalse)
+		_, ok = counterDelta(1e12, 10.0)
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("rateTracker", t, func() {
+		tracker := newRateTracker()
+		tags := map[string]string{"name": "foo"}
+
+		_, ok := tracker.rate(Metric{tags, 10000, 100.0})
+		So(ok, ShouldBeFalse)
+
+		rate, ok := tracker.rate(Metric{tags, 20000, 200.0})
+		So(ok, ShouldBeTrue)
+		So(rate, ShouldEqual, 10.0)
+
+		// Same timestamp, no rate
+		_, ok = tracker.rate(Metric{tags, 20000, 300.0})
+		So(ok, ShouldBeFalse)
+
+		// Reset
+		_, ok = tracker.rate(Metric{tags, 30000, 5.0})
+		So(ok, ShouldBeFalse)
+
+		rate, ok = tracker.rate(Metric{tags, 40000, 65.0})
+		So(ok, ShouldBeTrue)
+		So(rate, ShouldEqual, 6.0)
+
+		// Separate series
+		_, ok = tracker.rate(Metric{map[string]string{"name": "bar"}, 40000, 65.0})
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("rateTracker ignores out of order samples", t, func() {
+		tracker := newRateTracker()
+		tags := map[string]string{"name": "foo"}
+
+		tracker.rate(Metric{tags, 20000, 200.0})
+
+		// Older and duplicate samples do not replace the state
+		_, ok := tracker.rate(Metric{tags, 10000, 100.0})
+		So(ok, ShouldBeFalse)
+		_, ok = tracker.rate(Metric{tags, 20000, 250.0})
+		So(ok, ShouldBeFalse)
+		So(tracker.previous[tagsKey(tags)], ShouldResemble, counterSample{20000, 200.0})
+
+		rate, ok := tracker.rate(Metric{tags, 30000, 300.0})
+		So(ok, ShouldBeTrue)
+		So(rate, ShouldEqual, 10.0)
+	})
+
+	Convey("rateTracker expire", t, func() {
+		tracker := newRateTracker()
+		now := time.Now()
+		old := uint64(now.Add(-time.Hour).Unix() * 1000)
+		recent := uint64(now.Unix() * 1000)
+		tracker.rate(Metric{map[string]string{"name": "old"}, old, 1.0})
+		tracker.rate(Metric{map[string]string{"name": "recent"}, recent, 1.0})
+		tracker.expire(now)
+		So(len(tracker.previous), ShouldEqual, 1)
+	})
+
+	Convey("converter with counters", t, func() {
+		conv := &converter{
+			counters: regexp.MustCompile("^/intel/procfs/iface/.*/bytes_recv$"),
+			rates:    newRateTracker(),
+		}
+
+		ns := core.NewNamespace("intel", "procfs", "iface", "eth0", "bytes_recv")
+		t1 := time.Unix(1000, 0)
+		t2 := time.Unix(1060, 0)
+
+		input := []plugin.MetricType{
+			*plugin.NewMetricType(ns, t1, nil, "", 6000),
+			*plugin.NewMetricType(core.NewNamespace("foo"), t1, map[string]string{"type": "counter"}, "", 0),
+			*plugin.NewMetricType(core.NewNamespace("bar"), t1, nil, "", 42),
+		}
+		So(conv.toAtlasMetrics(input), ShouldResemble, []Metric{
+			Metric{map[string]string{"name": "bar"}, 1000000, 42.0},
+		})
+
+		input = []plugin.MetricType{
+			*plugin.NewMetricType(ns, t2, nil, "", 12000),
+			*plugin.NewMetricType(core.NewNamespace("foo"), t2, map[string]string{"type": "counter"}, "", 120),
+			*plugin.NewMetricType(core.NewNamespace("bar"), t2, nil, "", 42),
+		}
+		So(conv.toAtlasMetrics(input), ShouldResemble, []Metric{
+			Metric{map[string]string{"name": "intel.procfs.iface.eth0.bytes_recv", "atlas.dstype": "rate"}, 1060000, 100.0},
+			Metric{map[string]string{"name": "foo", "type": "counter", "atlas.dstype": "rate"}, 1060000, 2.0},
+			Metric{map[string]string{"name": "bar"}, 1060000, 42.0},
+		})
+	})
+}
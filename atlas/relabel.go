@@ -0,0 +1,180 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// Action performed by a tag rule.
+type tagAction int
+
+const (
+	// Change the key of a tag, keeping the value.
+	actionRename tagAction = iota
+
+	// Remove all tags with a key matching the pattern.
+	actionDrop
+
+	// Set a tag to a static value.
+	actionAdd
+
+	// Set a tag to the value of the source tag with the pattern replaced.
+	actionReplace
+)
+
+// Parse the name of an action as used in the config.
+func parseTagAction(s string) (tagAction, error) {
+	switch s {
+	case "rename":
+		return actionRename, nil
+	case "drop":
+		return actionDrop, nil
+	case "add":
+		return actionAdd, nil
+	case "replace":
+		return actionReplace, nil
+	default:
+		return actionRename, fmt.Errorf("invalid tag rule action '%s', must be one of: rename, drop, add, replace", s)
+	}
+}
+
+// Single rule for rewriting the tags of a metric.
+type tagRule struct {
+	action      tagAction
+	source      string
+	target      string
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// Ordered list of rules for rewriting tags. Each rule is applied to the
+// result of the previous rule.
+type tagRules []tagRule
+
+// Specification of a rule as used in the config.
+type tagRuleSpec struct {
+	Action      string `json:"action"`
+	Source      string `json:"source"`
+	Target      string `json:"target"`
+	Pattern     string `json:"pattern"`
+	Value       string `json:"value"`
+	Replacement string `json:"replacement"`
+}
+
+func newTagRule(spec tagRuleSpec) (tagRule, error) {
+	action, err := parseTagAction(spec.Action)
+	if err != nil {
+		return tagRule{}, err
+	}
+
+	rule := tagRule{action: action, source: spec.Source, target: spec.Target}
+	switch action {
+	case actionRename:
+		if spec.Source == "" || spec.Target == "" {
+			return rule, fmt.Errorf("rename rule requires source and target")
+		}
+	case actionDrop:
+		if spec.Pattern == "" {
+			return rule, fmt.Errorf("drop rule requires pattern")
+		}
+	case actionAdd:
+		if spec.Target == "" {
+			return rule, fmt.Errorf("add rule requires target")
+		}
+		rule.replacement = spec.Value
+	case actionReplace:
+		if spec.Source == "" || spec.Pattern == "" {
+			return rule, fmt.Errorf("replace rule requires source and pattern")
+		}
+		if rule.target == "" {
+			rule.target = spec.Source
+		}
+		rule.replacement = spec.Replacement
+	}
+
+	if spec.Pattern != "" {
+		rule.pattern, err = regexp.Compile(spec.Pattern)
+		if err != nil {
+			return rule, fmt.Errorf("invalid tag rule pattern '%s': %v", spec.Pattern, err)
+		}
+	}
+	return rule, nil
+}
+
+// Parse the rules from a JSON array of objects with the action and the
+// fields used by that action, e.g.:
+//
+//	[
+//	  {"action": "rename", "source": "plugin_running_on", "target": "nf.node"},
+//	  {"action": "drop", "pattern": "^internal\\."},
+//	  {"action": "add", "target": "nf.app", "value": "www"},
+//	  {"action": "replace", "source": "name", "pattern": "^intel\\.", "replacement": ""}
+//	]
+//
+// For replace, the target defaults to the source and the replacement can
+// refer to capture groups in the pattern using $1 or ${name}.
+func parseTagRules(s string) (tagRules, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var specs []tagRuleSpec
+	if err := json.Unmarshal([]byte(s), &specs); err != nil {
+		return nil, fmt.Errorf("invalid tag rules: %v", err)
+	}
+
+	var rules tagRules
+	for i, spec := range specs {
+		rule, err := newTagRule(spec)
+		if err != nil {
+			return nil, fmt.Errorf("tag rule %d: %v", i, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r tagRule) apply(tags map[string]string) {
+	switch r.action {
+	case actionRename:
+		if v, ok := tags[r.source]; ok {
+			delete(tags, r.source)
+			tags[r.target] = v
+		}
+	case actionDrop:
+		for k := range tags {
+			if r.pattern.MatchString(k) {
+				delete(tags, k)
+			}
+		}
+	case actionAdd:
+		tags[r.target] = r.replacement
+	case actionReplace:
+		if v, ok := tags[r.source]; ok && r.pattern.MatchString(v) {
+			tags[r.target] = r.pattern.ReplaceAllString(v, r.replacement)
+		}
+	}
+}
+
+// Apply the rules in order. The tag map is modified in place.
+func (r tagRules) apply(tags map[string]string) {
+	for _, rule := range r {
+		rule.apply(tags)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRelabel(t *testing.T) {
+
+	newTags := func() map[string]string {
+		return map[string]string{
+			"name":              "intel.procfs.cpu.user",
+			"plugin_running_on": "i-12345",
+			"internal.id":       "1",
+			"internal.seq":      "2",
+		}
+	}
+
+	applyRules := func(s string) map[string]string {
+		rules, err := parseTagRules(s)
+		So(err, ShouldBeNil)
+		tags := newTags()
+		rules.apply(tags)
+		return tags
+	}
+
+	Convey("rename", t, func() {
+		tags := applyRules(`[{"action": "rename", "source": "plugin_running_on", "target": "nf.node"}]`)
+		So(tags, ShouldResemble, map[string]string{
+			"name":         "intel.procfs.cpu.user",
+			"nf.node":      "i-12345",
+			"internal.id":  "1",
+			"internal.seq": "2",
+		})
+
+		// Missing source is ignored
+		tags = applyRules(`[{"action": "rename", "source": "foo", "target": "bar"}]`)
+		So(tags, ShouldResemble, newTags())
+	})
+
+	Convey("drop", t, func() {
+		tags := applyRules(`[{"action": "drop", "pattern": "^internal\\."}]`)
+		So(tags, ShouldResemble, map[string]string{
+			"name":              "intel.procfs.cpu.user",
+			"plugin_running_on": "i-12345",
+		})
+	})
+
+	Convey("add", t, func() {
+		tags := applyRules(`[
+			{"action": "add", "target": "nf.app", "value": "www"},
+			{"action": "add", "target": "internal.id", "value": "3"}
+		]`)
+		expected := newTags()
+		expected["nf.app"] = "www"
+		expected["internal.id"] = "3"
+		So(tags, ShouldResemble, expected)
+	})
+
+	Convey("replace", t, func() {
+		tags := applyRules(`[{"action": "replace", "source": "name", "pattern": "^intel\\.procfs\\.", "replacement": ""}]`)
+		So(tags["name"], ShouldEqual, "cpu.user")
+
+		tags = applyRules(`[{
+			"action": "replace", "source": "name", "target": "id",
+			"pattern": "^intel\\.procfs\\.(?P<type>[^.]+)\\.(.*)$", "replacement": "${type}-$2"
+		}]`)
+		So(tags["name"], ShouldEqual, "intel.procfs.cpu.user")
+		So(tags["id"], ShouldEqual, "cpu-user")
+
+		// No match leaves the tags unchanged
+		tags = applyRules(`[{"action": "replace", "source": "name", "target": "id", "pattern": "^foo", "replacement": "bar"}]`)
+		So(tags, ShouldResemble, newTags())
+	})
+
+	Convey("rules are applied in order", t, func() {
+		tags := applyRules(`[
+			{"action": "rename", "source": "plugin_running_on", "target": "node"},
+			{"action": "replace", "source": "node", "pattern": "^i-", "replacement": "node-"},
+			{"action": "drop", "pattern": "^(internal\\..*|plugin_running_on)$"}
+		]`)
+		So(tags, ShouldResemble, map[string]string{
+			"name": "intel.procfs.cpu.user",
+			"node": "node-12345",
+		})
+	})
+
+	Convey("invalid rules", t, func() {
+		invalid := []string{
+			`{}`,
+			`[{"action": "copy"}]`,
+			`[{"action": "rename", "source": "foo"}]`,
+			`[{"action": "drop"}]`,
+			`[{"action": "drop", "pattern": "(foo"}]`,
+			`[{"action": "add", "value": "foo"}]`,
+			`[{"action": "replace", "source": "foo"}]`,
+			`[{"action": "replace", "source": "foo", "pattern": "(foo"}]`,
+		}
+		for _, s := range invalid {
+			_, err := parseTagRules(s)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("converter applies tag rules", t, func() {
+		rules, _ := parseTagRules(`[{"action": "rename", "source": "host", "target": "nf.node"}]`)
+		conv := &converter{tagRules: rules}
+		input := []plugin.MetricType{
+			*plugin.NewMetricType(core.NewNamespace("foo"), time.Unix(1, 0), map[string]string{"host": "i-1"}, "", 1),
+		}
+		So(conv.toAtlasMetrics(input), ShouldResemble, []Metric{
+			Metric{map[string]string{"name": "foo", "nf.node": "i-1"}, 1000, 1.0},
+		})
+	})
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Minimum amount of time between log messages for datapoints rejected by the
+// server for the same reason.
+const rejectionLogInterval = time.Minute
+
+// Maximum number of reasons to track for rate limiting the log messages. If
+// exceeded, then the state is reset.
+const maxRejectionReasons = 1000
+
+// Outcome for a payload where the server rejected some or all of the
+// datapoints because they failed validation.
+type ValidationResult struct {
+	// Number of datapoints that were accepted by the server.
+	Accepted int
+
+	// Number of datapoints that were rejected by the server.
+	Rejected int
+
+	// Messages from the server explaining why datapoints were rejected.
+	Messages []string
+}
+
+// Body of the response from the Atlas publish endpoint for a 202 or 400
+// status code.
+type publishResponse struct {
+	Type       string   `json:"type"`
+	ErrorCount int      `json:"errorCount"`
+	Message    []string `json:"message"`
+}
+
+// Parse the body of a response from the publish endpoint. Returns false if
+// the body does not have the details for rejected datapoints.
+func parseValidationResult(body []byte) (ValidationResult, bool) {
+	var response publishResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return ValidationResult{}, false
+	}
+	if response.ErrorCount <= 0 && len(response.Message) == 0 {
+		return ValidationResult{}, false
+	}
+	return ValidationResult{Rejected: response.ErrorCount, Messages: response.Message}, true
+}
+
+// Error for a response where the server rejected some or all of the
+// datapoints in the payload. For a 202 status code, the other datapoints
+// were accepted so the payload should not be sent again.
+type rejectedError struct {
+	StatusCode int
+	Body       string
+	Result     ValidationResult
+}
+
+func (e *rejectedError) Error() string {
+	msg := fmt.Sprintf("status code %d: %d datapoints rejected", e.StatusCode, e.Result.Rejected)
+	if len(e.Result.Messages) > 0 {
+		msg = fmt.Sprintf("%s: %s", msg, strings.Join(e.Result.Messages, "; "))
+	}
+	return msg
+}
+
+// Get the reason from a validation message. Messages typically have the form
+// "reason: details", so the portion before the first colon is used.
+func rejectionReason(msg string) string {
+	if pos := strings.Index(msg, ":"); pos > 0 {
+		return strings.TrimSpace(msg[:pos])
+	}
+	return strings.TrimSpace(msg)
+}
+
+// Log that only allows a message for a given key once per interval.
+type rateLimitedLog struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time
+}
+
+func newRateLimitedLog(interval time.Duration) *rateLimitedLog {
+	return &rateLimitedLog{interval: interval, last: make(map[string]time.Time)}
+}
+
+// Returns true if a message for the key should be logged.
+func (l *rateLimitedLog) allow(key string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if t, ok := l.last[key]; ok && now.Sub(t) < l.interval {
+		return false
+	}
+	if len(l.last) >= maxRejectionReasons {
+		l.last = make(map[string]time.Time)
+	}
+	l.last[key] = now
+	return true
+}
+
+// Shared across clients since a new client is created for each call to
+// Publish.
+var rejectionLog = newRateLimitedLog(rejectionLogInterval)
+
+// Log the messages for rejected datapoints. Each reason is only logged once
+// per interval for a given URI.
+func logRejected(uri string, result ValidationResult, rlog *rateLimitedLog, now time.Time) {
+	logger := log.New()
+	for _, msg := range result.Messages {
+		if rlog.allow(uri+" "+rejectionReason(msg), now) {
+			logger.Warnf("datapoints rejected by %s: %s", uri, msg)
+		}
+	}
+}
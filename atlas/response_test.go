@@ -0,0 +1,151 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestResponse(t *testing.T) {
+
+	Convey("parseValidationResult", t, func() {
+		result, ok := parseValidationResult([]byte(`{"type":"partial","errorCount":2,"message":["a: foo","b: bar"]}`))
+		So(ok, ShouldBeTrue)
+		So(result, ShouldResemble, ValidationResult{Rejected: 2, Messages: []string{"a: foo", "b: bar"}})
+
+		for _, body := range []string{"", "invalid datapoints", "{}", `{"type":"partial","errorCount":0}`} {
+			_, ok := parseValidationResult([]byte(body))
+			So(ok, ShouldBeFalse)
+		}
+	})
+
+	Convey("rejectedError", t, func() {
+		err := &rejectedError{202, "", ValidationResult{Rejected: 1, Messages: []string{"too old"}}}
+		So(err.Error(), ShouldEqual, "status code 202: 1 datapoints rejected: too old")
+		So(isRetryable(err), ShouldBeFalse)
+	})
+
+	Convey("rejectionReason", t, func() {
+		So(rejectionReason("invalid key: foo bar"), ShouldEqual, "invalid key")
+		So(rejectionReason(" too old "), ShouldEqual, "too old")
+		So(rejectionReason(":foo"), ShouldEqual, ":foo")
+	})
+
+	Convey("rateLimitedLog", t, func() {
+		rlog := newRateLimitedLog(time.Minute)
+		now := time.Unix(1000, 0)
+		So(rlog.allow("a", now), ShouldBeTrue)
+		So(rlog.allow("a", now.Add(time.Second)), ShouldBeFalse)
+		So(rlog.allow("b", now.Add(time.Second)), ShouldBeTrue)
+		So(rlog.allow("a", now.Add(time.Minute)), ShouldBeTrue)
+
+		// State is reset if there are too many keys
+		for i := 0; i < maxRejectionReasons+1; i++ {
+			rlog.allow(string(rune('a'+i)), now)
+		}
+		So(len(rlog.last), ShouldBeLessThanOrEqualTo, maxRejectionReasons)
+	})
+
+	Convey("partial failure is treated as success", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(202)
+			w.Write([]byte(`{"type":"partial","errorCount":1,"message":["too many tags: foo"]}`))
+		}))
+		defer server.Close()
+
+		options := DefaultClientOptions()
+		options.Stats = &ClientStats{}
+		client := NewAtlasClientWithOptions(server.URL, map[string]string{}, options)
+		err := client.Publish([]Metric{
+			Metric{map[string]string{"name": "foo"}, 0, 1.0},
+			Metric{map[string]string{"name": "bar"}, 0, 2.0},
+		})
+		So(err, ShouldBeNil)
+		So(options.Stats.counters[statID{"atlas.publisher.dropped", "reason", dropRejected}], ShouldEqual, 1.0)
+		So(options.Stats.counters[statID{"atlas.publisher.requests", "statusCode", "202"}], ShouldEqual, 1.0)
+		So(options.Stats.PayloadBytes(), ShouldBeGreaterThan, 0)
+	})
+
+	Convey("partial failure is included in the result", t, func() {
+		body := `{"type":"partial","errorCount":1,"message":["too many tags: foo"]}`
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(202)
+			w.Write([]byte(body))
+		}))
+		defer server.Close()
+
+		client := NewAtlasClient(server.URL, map[string]string{}).(httpAtlasClient)
+		result, err := client.PublishWithResult([]Metric{
+			Metric{map[string]string{"name": "foo"}, 0, 1.0},
+			Metric{map[string]string{"name": "bar"}, 0, 2.0},
+		})
+		So(err, ShouldBeNil)
+		So(len(result.Partial), ShouldEqual, 1)
+		partial := result.Partial[0]
+		So(partial.Batch, ShouldEqual, 0)
+		So(partial.StatusCode, ShouldEqual, 202)
+		So(partial.Body, ShouldEqual, body)
+		So(partial.Dropped, ShouldEqual, 1)
+		So(partial.Validation, ShouldResemble, &ValidationResult{
+			Accepted: 1,
+			Rejected: 1,
+			Messages: []string{"too many tags: foo"},
+		})
+		So(result.Rejected(), ShouldEqual, 1)
+	})
+
+	Convey("accepted without details", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(202)
+		}))
+		defer server.Close()
+
+		client := NewAtlasClient(server.URL, map[string]string{})
+		So(client.Publish([]Metric{Metric{map[string]string{"name": "foo"}, 0, 1.0}}), ShouldBeNil)
+	})
+
+	Convey("all datapoints rejected", t, func() {
+		body := `{"type":"error","errorCount":2,"message":["too old: foo","too old: bar"]}`
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(400)
+			w.Write([]byte(body))
+		}))
+		defer server.Close()
+
+		client := NewAtlasClient(server.URL, map[string]string{})
+		err := client.Publish([]Metric{
+			Metric{map[string]string{"name": "foo"}, 0, 1.0},
+			Metric{map[string]string{"name": "bar"}, 0, 2.0},
+		}).(*PublishError)
+		So(requests, ShouldEqual, 1)
+		failure := err.Failures[0]
+		So(failure.StatusCode, ShouldEqual, 400)
+		So(failure.Body, ShouldEqual, body)
+		So(failure.Dropped, ShouldEqual, 2)
+		So(failure.Validation, ShouldResemble, &ValidationResult{
+			Accepted: 0,
+			Rejected: 2,
+			Messages: []string{"too old: foo", "too old: bar"},
+		})
+	})
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Policy for retrying POST requests to Atlas that fail with a transient
+// error.
+type RetryPolicy struct {
+	// Maximum number of attempts including the initial request. A value
+	// of 1 or less will disable retries.
+	MaxAttempts int
+
+	// Delay before the first retry. The delay is doubled for each
+	// subsequent retry.
+	InitialBackoff time.Duration
+
+	// Upper bound on the delay between attempts. This also limits how long
+	// we will wait if the server sends a Retry-After header.
+	MaxBackoff time.Duration
+
+	// Fraction of the delay, in the range [0.0, 1.0], that is randomized to
+	// avoid many clients retrying at the same time.
+	Jitter float64
+}
+
+// Returns the default retry policy.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		Jitter:         0.2,
+	}
+}
+
+// Verify the settings are in the supported ranges.
+func checkRetryPolicy(p RetryPolicy) error {
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("retry_max_attempts cannot be negative: %d", p.MaxAttempts)
+	}
+	if p.InitialBackoff < 0 || p.MaxBackoff < 0 {
+		return fmt.Errorf("retry_initial_backoff_ms and retry_max_backoff_ms cannot be negative")
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		return fmt.Errorf("retry_max_backoff_ms (%v) must be greater than or equal to retry_initial_backoff_ms (%v)",
+			p.MaxBackoff, p.InitialBackoff)
+	}
+	if p.Jitter < 0.0 || p.Jitter > 1.0 || math.IsNaN(p.Jitter) {
+		return fmt.Errorf("retry_jitter must be in the range [0.0, 1.0]: %v", p.Jitter)
+	}
+	return nil
+}
+
+// Compute the delay before the next attempt. The retry parameter is the
+// number of retries that have already been performed and the random
+// function should return a value in the range [0.0, 1.0).
+func (p RetryPolicy) backoff(retry int, random func() float64) time.Duration {
+	delay := p.InitialBackoff
+	for i := 0; i < retry && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if p.Jitter > 0.0 {
+		delay -= time.Duration(float64(delay) * p.Jitter * random())
+	}
+	return delay
+}
+
+// Returns true if the error is likely to be transient so the request should
+// be retried. Network errors, throttling (429), and server errors (5xx) can
+// be retried. Other status codes such as a 400 for a validation failure will
+// fail the same way if retried. Responses where the server rejected some of
+// the datapoints are never retried. Any other error, such as an invalid URI
+// or a payload that could not be encoded, is treated as permanent.
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case *httpError:
+		return e.StatusCode == 429 || e.StatusCode >= 500
+	case *url.Error:
+		// The HTTP client wraps all errors, including an unsupported scheme,
+		// so check the underlying cause
+		return isNetworkError(e.Err)
+	}
+	return isNetworkError(err)
+}
+
+// Returns true if the error is from the network, e.g. a timeout or a
+// connection that was refused or reset.
+func isNetworkError(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF, syscall.ECONNREFUSED, syscall.ECONNRESET:
+		return true
+	}
+	return false
+}
+
+// Parse the value of a Retry-After header. The value can either be a number
+// of seconds or an HTTP date. Returns 0 if the header is not present or could
+// not be parsed.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// Wrap the post function so that requests failing with a retryable error
+// will be attempted again based on the policy.
+func (p RetryPolicy) withRetries(uri string, doPost func([]byte) error, sleep func(time.Duration)) func([]byte) error {
+	return func(data []byte) error {
+		logger := log.New()
+		var err error
+		for attempt := 1; ; attempt++ {
+			err = doPost(data)
+			if err == nil || attempt >= p.MaxAttempts || !isRetryable(err) {
+				return err
+			}
+
+			delay := p.backoff(attempt-1, rand.Float64)
+			if e, ok := err.(*httpError); ok && e.RetryAfter > delay {
+				delay = e.RetryAfter
+				if delay > p.MaxBackoff {
+					delay = p.MaxBackoff
+				}
+			}
+			logger.Warnf("attempt %d of %d to %s failed, retrying in %v: %v",
+				attempt, p.MaxAttempts, uri, delay, err)
+			sleep(delay)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Create a test server that will respond with the scripted status codes in
+// order. Once the script is exhausted it will respond with 200.
+func newScriptedServer(statusCodes []int, header map[string]string) (*httptest.Server, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := requests
+		requests++
+		for k, v := range header {
+			w.Header().Set(k, v)
+		}
+		if i < len(statusCodes) {
+			w.WriteHeader(statusCodes[i])
+		} else {
+			w.WriteHeader(200)
+		}
+	}))
+	return server, &requests
+}
+
+func TestRetry(t *testing.T) {
+
+	policy := RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Jitter:         0.0,
+	}
+
+	Convey("checkRetryPolicy", t, func() {
+		So(checkRetryPolicy(DefaultRetryPolicy()), ShouldBeNil)
+
+		p := DefaultRetryPolicy()
+		p.MaxAttempts = 0
+		p.Jitter = 1.0
+		So(checkRetryPolicy(p), ShouldBeNil)
+
+		invalid := []func(p *RetryPolicy){
+			func(p *RetryPolicy) { p.MaxAttempts = -1 },
+			func(p *RetryPolicy) { p.InitialBackoff = -time.Second },
+			func(p *RetryPolicy) { p.MaxBackoff = p.InitialBackoff - 1 },
+			func(p *RetryPolicy) { p.Jitter = 1.1 },
+			func(p *RetryPolicy) { p.Jitter = -0.5 },
+			func(p *RetryPolicy) { p.Jitter = math.NaN() },
+		}
+		for _, f := range invalid {
+			p := DefaultRetryPolicy()
+			f(&p)
+			So(checkRetryPolicy(p), ShouldNotBeNil)
+		}
+	})
+
+	Convey("backoff", t, func() {
+		zero := func() float64 { return 0.0 }
+		So(policy.backoff(0, zero), ShouldEqual, 100*time.Millisecond)
+		So(policy.backoff(1, zero), ShouldEqual, 200*time.Millisecond)
+		So(policy.backoff(2, zero), ShouldEqual, 400*time.Millisecond)
+		So(policy.backoff(3, zero), ShouldEqual, 800*time.Millisecond)
+		So(policy.backoff(4, zero), ShouldEqual, time.Second)
+		So(policy.backoff(100, zero), ShouldEqual, time.Second)
+	})
+
+	Convey("backoff with jitter", t, func() {
+		p := policy
+		p.Jitter = 0.5
+		So(p.backoff(0, func() float64 { return 0.0 }), ShouldEqual, 100*time.Millisecond)
+		So(p.backoff(0, func() float64 { return 0.5 }), ShouldEqual, 75*time.Millisecond)
+		So(p.backoff(0, func() float64 { return 1.0 }), ShouldEqual, 50*time.Millisecond)
+	})
+
+	Convey("isRetryable", t, func() {
+		refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+		So(isRetryable(refused), ShouldBeTrue)
+		So(isRetryable(&url.Error{Op: "Post", URL: "http://foo", Err: refused}), ShouldBeTrue)
+		So(isRetryable(io.EOF), ShouldBeTrue)
+		So(isRetryable(syscall.ECONNRESET), ShouldBeTrue)
+		So(isRetryable(&httpError{429, "", 0}), ShouldBeTrue)
+		So(isRetryable(&httpError{500, "", 0}), ShouldBeTrue)
+		So(isRetryable(&httpError{503, "", 0}), ShouldBeTrue)
+		So(isRetryable(&httpError{400, "", 0}), ShouldBeFalse)
+		So(isRetryable(&httpError{404, "", 0}), ShouldBeFalse)
+		So(isRetryable(&rejectedError{202, "", ValidationResult{}}), ShouldBeFalse)
+
+		// Errors that are not from the network will fail the same way
+		So(isRetryable(errors.New("failed")), ShouldBeFalse)
+		So(isRetryable(&url.Error{Op: "Post", URL: "foo://bar", Err: errors.New("unsupported protocol scheme")}), ShouldBeFalse)
+		_, err := json.Marshal(math.NaN())
+		So(isRetryable(err), ShouldBeFalse)
+	})
+
+	Convey("parseRetryAfter", t, func() {
+		now := time.Date(2016, 9, 1, 12, 0, 0, 0, time.UTC)
+		So(parseRetryAfter("", now), ShouldEqual, 0)
+		So(parseRetryAfter("foo", now), ShouldEqual, 0)
+		So(parseRetryAfter("-1", now), ShouldEqual, 0)
+		So(parseRetryAfter("5", now), ShouldEqual, 5*time.Second)
+		So(parseRetryAfter("Thu, 01 Sep 2016 12:00:30 GMT", now), ShouldEqual, 30*time.Second)
+		So(parseRetryAfter("Thu, 01 Sep 2016 11:00:00 GMT", now), ShouldEqual, 0)
+	})
+
+	Convey("withRetries succeeds after transient failures", t, func() {
+		server, requests := newScriptedServer([]int{503, 500}, nil)
+		defer server.Close()
+
+		var delays []time.Duration
+		sleep := func(d time.Duration) { delays = append(delays, d) }
+
+		client := NewAtlasClientWithOptions(server.URL, map[string]string{}, ClientOptions{Retry: policy}).(httpAtlasClient)
+		client.sleep = sleep
+		err := client.Publish([]Metric{
+			Metric{map[string]string{"name": "foo"}, 0, 1.0},
+		})
+		So(err, ShouldBeNil)
+		So(*requests, ShouldEqual, 3)
+		So(delays, ShouldResemble, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond})
+	})
+
+	Convey("withRetries gives up after max attempts", t, func() {
+		server, requests := newScriptedServer([]int{503, 503, 503, 503}, nil)
+		defer server.Close()
+
+		client := NewAtlasClientWithOptions(server.URL, map[string]string{}, ClientOptions{Retry: policy}).(httpAtlasClient)
+		client.sleep = func(d time.Duration) {}
+		err := client.Publish([]Metric{
+			Metric{map[string]string{"name": "foo"}, 0, 1.0},
+		}).(*PublishError)
+		So(err.Failures[0].StatusCode, ShouldEqual, 503)
+		So(*requests, ShouldEqual, 3)
+	})
+
+	Convey("withRetries does not retry validation failures", t, func() {
+		server, requests := newScriptedServer([]int{400}, nil)
+		defer server.Close()
+
+		client := NewAtlasClientWithOptions(server.URL, map[string]string{}, ClientOptions{Retry: policy}).(httpAtlasClient)
+		client.sleep = func(d time.Duration) {}
+		err := client.Publish([]Metric{
+			Metric{map[string]string{"name": "foo"}, 0, 1.0},
+		}).(*PublishError)
+		So(err.Failures[0].StatusCode, ShouldEqual, 400)
+		So(*requests, ShouldEqual, 1)
+	})
+
+	Convey("withRetries honors Retry-After", t, func() {
+		server, requests := newScriptedServer([]int{429}, map[string]string{"Retry-After": "0"})
+		defer server.Close()
+
+		var delays []time.Duration
+		sleep := func(d time.Duration) { delays = append(delays, d) }
+
+		p := policy
+		p.InitialBackoff = 0
+		client := NewAtlasClientWithOptions(server.URL, map[string]string{}, ClientOptions{Retry: p}).(httpAtlasClient)
+		client.sleep = sleep
+		So(client.Publish([]Metric{Metric{map[string]string{"name": "foo"}, 0, 1.0}}), ShouldBeNil)
+		So(*requests, ShouldEqual, 2)
+		So(delays, ShouldResemble, []time.Duration{0})
+
+		f := func(data []byte) error {
+			return &httpError{429, "", 10 * time.Second}
+		}
+		delays = nil
+		p.MaxAttempts = 2
+		p.withRetries("test", f, sleep)(nil)
+		So(delays, ShouldResemble, []time.Duration{time.Second})
+
+		p.MaxBackoff = time.Minute
+		delays = nil
+		p.withRetries("test", f, sleep)(nil)
+		So(delays, ShouldResemble, []time.Duration{10 * time.Second})
+	})
+
+	Convey("withRetries disabled", t, func() {
+		p := policy
+		p.MaxAttempts = 1
+		calls := 0
+		f := func(data []byte) error {
+			calls++
+			return errors.New("connection refused")
+		}
+		So(p.withRetries("test", f, func(d time.Duration) {})(nil), ShouldNotBeNil)
+		So(calls, ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Policy for handling new datapoints when the queue is full.
+type dropPolicy int
+
+const (
+	// Remove the oldest datapoints from the queue to make room.
+	dropOldest dropPolicy = iota
+
+	// Discard the new datapoints that do not fit in the queue.
+	dropNewest
+
+	// Wait until there is room in the queue.
+	block
+)
+
+// Parse the name of a drop policy as used in the config.
+func parseDropPolicy(s string) (dropPolicy, error) {
+	switch s {
+	case "drop-oldest":
+		return dropOldest, nil
+	case "drop-newest":
+		return dropNewest, nil
+	case "block":
+		return block, nil
+	default:
+		return dropOldest, fmt.Errorf("invalid drop policy '%s', must be one of: drop-oldest, drop-newest, block", s)
+	}
+}
+
+// Settings for the background sender.
+type senderOptions struct {
+	// Maximum number of datapoints that can be buffered.
+	QueueSize int
+
+	// How often to send the buffered datapoints.
+	FlushInterval time.Duration
+
+	// Number of buffered datapoints that will trigger a send before the
+	// flush interval has elapsed.
+	FlushSize int
+
+	// What to do when the queue is full.
+	DropPolicy dropPolicy
+}
+
+// Returns the default settings for the background sender.
+func defaultSenderOptions() senderOptions {
+	return senderOptions{
+		QueueSize:     100000,
+		FlushInterval: 5 * time.Second,
+		FlushSize:     metricBatchSize,
+		DropPolicy:    dropOldest,
+	}
+}
+
+// Buffers datapoints in memory and sends them to Atlas from a background
+// goroutine so that the caller does not have to wait on the backend.
+type asyncSender struct {
+	uri     string
+	options senderOptions
+
+	mutex   sync.Mutex
+	notFull *sync.Cond
+	client  AtlasClient
+	queue   []Metric
+	dropped int
+	lastErr error
+	closed  bool
+
+	flushNow chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// Create a new sender and start the background goroutine.
+func newAsyncSender(uri string, client AtlasClient, options senderOptions) *asyncSender {
+	s := &asyncSender{
+		uri:      uri,
+		options:  options,
+		client:   client,
+		flushNow: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	s.notFull = sync.NewCond(&s.mutex)
+	go s.run()
+	return s
+}
+
+// Update the client used for sending. The settings for the client such as
+// the common tags can change between calls to Publish.
+func (s *asyncSender) setClient(client AtlasClient) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.client = client
+}
+
+// Add the datapoints to the queue. Returns the number of datapoints that
+// were dropped because the queue was full.
+func (s *asyncSender) enqueue(metrics []Metric) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	dropped := 0
+	for _, m := range metrics {
+		for !s.closed && s.options.DropPolicy == block && len(s.queue) >= s.options.QueueSize {
+			s.signalFlush()
+			s.notFull.Wait()
+		}
+
+		if s.closed {
+			dropped++
+		} else if len(s.queue) < s.options.QueueSize {
+			s.queue = append(s.queue, m)
+		} else if s.options.DropPolicy == dropOldest {
+			s.queue = append(s.queue[1:], m)
+			dropped++
+		} else {
+			dropped++
+		}
+	}
+	s.dropped += dropped
+
+	if len(s.queue) >= s.options.FlushSize {
+		s.signalFlush()
+	}
+	return dropped
+}
+
+// Wake up the background goroutine to send the queued datapoints. Must be
+// called with the lock held.
+func (s *asyncSender) signalFlush() {
+	select {
+	case s.flushNow <- struct{}{}:
+	default:
+	}
+}
+
+// Return the number of datapoints dropped due to a full queue and the error
+// from the most recent send that failed, if any, since the last call. Both
+// are reset after being returned.
+func (s *asyncSender) status() (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	dropped, err := s.dropped, s.lastErr
+	s.dropped = 0
+	s.lastErr = nil
+	return dropped, err
+}
+
+// Send all datapoints currently in the queue.
+func (s *asyncSender) flush() error {
+	s.mutex.Lock()
+	metrics := s.queue
+	client := s.client
+	s.queue = nil
+	s.notFull.Broadcast()
+	s.mutex.Unlock()
+
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	err := client.Publish(metrics)
+	if err != nil {
+		s.mutex.Lock()
+		s.lastErr = err
+		s.mutex.Unlock()
+	}
+	return err
+}
+
+// Main loop for the background goroutine.
+func (s *asyncSender) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(s.options.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.flushNow:
+			s.flush()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Stop the background goroutine and send any datapoints that are still in
+// the queue.
+func (s *asyncSender) close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.notFull.Broadcast()
+	s.mutex.Unlock()
+
+	close(s.done)
+	<-s.stopped
+
+	logger := log.New()
+	logger.Infof("flushing queued metrics to %s", s.uri)
+	return s.flush()
+}
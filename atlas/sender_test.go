@@ -0,0 +1,184 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Client that records the metrics that are published.
+type recordingClient struct {
+	mutex   sync.Mutex
+	batches [][]Metric
+	err     error
+}
+
+func (c *recordingClient) Publish(metrics []Metric) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.batches = append(c.batches, metrics)
+	return c.err
+}
+
+func (c *recordingClient) names() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var names []string
+	for _, batch := range c.batches {
+		for _, m := range batch {
+			names = append(names, m.Tags["name"])
+		}
+	}
+	return names
+}
+
+func newTestMetrics(prefix string, n int) []Metric {
+	metrics := make([]Metric, n)
+	for i := range metrics {
+		metrics[i] = Metric{map[string]string{"name": fmt.Sprintf("%s%d", prefix, i)}, 0, 1.0}
+	}
+	return metrics
+}
+
+func TestSender(t *testing.T) {
+
+	options := senderOptions{
+		QueueSize:     3,
+		FlushInterval: time.Hour,
+		FlushSize:     100,
+		DropPolicy:    dropOldest,
+	}
+
+	Convey("parseDropPolicy", t, func() {
+		p, err := parseDropPolicy("drop-oldest")
+		So(err, ShouldBeNil)
+		So(p, ShouldEqual, dropOldest)
+
+		p, err = parseDropPolicy("drop-newest")
+		So(err, ShouldBeNil)
+		So(p, ShouldEqual, dropNewest)
+
+		p, err = parseDropPolicy("block")
+		So(err, ShouldBeNil)
+		So(p, ShouldEqual, block)
+
+		_, err = parseDropPolicy("foo")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("drop oldest", t, func() {
+		client := &recordingClient{}
+		sender := newAsyncSender("test", client, options)
+		So(sender.enqueue(newTestMetrics("a", 5)), ShouldEqual, 2)
+
+		dropped, err := sender.status()
+		So(dropped, ShouldEqual, 2)
+		So(err, ShouldBeNil)
+
+		So(sender.close(), ShouldBeNil)
+		So(client.names(), ShouldResemble, []string{"a2", "a3", "a4"})
+	})
+
+	Convey("drop newest", t, func() {
+		client := &recordingClient{}
+		opts := options
+		opts.DropPolicy = dropNewest
+		sender := newAsyncSender("test", client, opts)
+		So(sender.enqueue(newTestMetrics("a", 5)), ShouldEqual, 2)
+		So(sender.close(), ShouldBeNil)
+		So(client.names(), ShouldResemble, []string{"a0", "a1", "a2"})
+	})
+
+	Convey("block", t, func() {
+		client := &recordingClient{}
+		opts := options
+		opts.DropPolicy = block
+		sender := newAsyncSender("test", client, opts)
+		So(sender.enqueue(newTestMetrics("a", 7)), ShouldEqual, 0)
+		So(sender.close(), ShouldBeNil)
+		So(len(client.names()), ShouldEqual, 7)
+	})
+
+	Convey("flush size triggers send", t, func() {
+		client := &recordingClient{}
+		opts := options
+		opts.QueueSize = 100
+		opts.FlushSize = 2
+		sender := newAsyncSender("test", client, opts)
+		defer sender.close()
+
+		sender.enqueue(newTestMetrics("a", 2))
+		for i := 0; i < 100 && len(client.names()) == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(client.names(), ShouldResemble, []string{"a0", "a1"})
+	})
+
+	Convey("flush interval triggers send", t, func() {
+		client := &recordingClient{}
+		opts := options
+		opts.FlushInterval = 10 * time.Millisecond
+		sender := newAsyncSender("test", client, opts)
+		defer sender.close()
+
+		sender.enqueue(newTestMetrics("a", 1))
+		for i := 0; i < 100 && len(client.names()) == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(client.names(), ShouldResemble, []string{"a0"})
+	})
+
+	Convey("failed send is reported", t, func() {
+		client := &recordingClient{err: errors.New("failed")}
+		sender := newAsyncSender("test", client, options)
+		sender.enqueue(newTestMetrics("a", 1))
+		So(sender.flush(), ShouldNotBeNil)
+
+		dropped, err := sender.status()
+		So(dropped, ShouldEqual, 0)
+		So(err, ShouldNotBeNil)
+
+		_, err = sender.status()
+		So(err, ShouldBeNil)
+		sender.close()
+	})
+
+	Convey("enqueue after close", t, func() {
+		client := &recordingClient{}
+		sender := newAsyncSender("test", client, options)
+		So(sender.close(), ShouldBeNil)
+		So(sender.close(), ShouldBeNil)
+		So(sender.enqueue(newTestMetrics("a", 2)), ShouldEqual, 2)
+		So(client.names(), ShouldBeEmpty)
+	})
+
+	Convey("setClient", t, func() {
+		client1 := &recordingClient{}
+		client2 := &recordingClient{}
+		sender := newAsyncSender("test", client1, options)
+		sender.setClient(client2)
+		sender.enqueue(newTestMetrics("a", 1))
+		sender.close()
+		So(client1.names(), ShouldBeEmpty)
+		So(client2.names(), ShouldResemble, []string{"a0"})
+	})
+}
@@ -0,0 +1,557 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// File extension used for spool segments.
+const spoolSuffix = ".spool"
+
+// File extension used for the metadata kept alongside each segment.
+const spoolMetaSuffix = ".meta"
+
+// Size of the segment metadata. It has the time the first record was written
+// as nanoseconds since the epoch followed by the replay offset, both encoded
+// as big-endian uint64 values.
+const spoolMetaSize = 16
+
+// Size of the header for each record. The header has the length of the
+// payload followed by the CRC-32 checksum of the payload, both encoded as
+// big-endian uint32 values.
+const spoolHeaderSize = 8
+
+// Maximum size of a single record. A larger length in the header indicates
+// that the header is corrupt.
+const spoolMaxRecordSize = 64 * 1024 * 1024
+
+// Returned when reading a record that is truncated or fails the checksum.
+var errCorruptRecord = errors.New("corrupt spool record")
+
+// Settings for the on-disk spool.
+type SpoolOptions struct {
+	// Directory where the segment files will be stored.
+	Dir string
+
+	// Maximum number of bytes across all segments. If exceeded, then the
+	// oldest segments will be discarded.
+	MaxBytes int64
+
+	// Maximum age of a segment based on the time the first record was
+	// written. Older segments will be discarded without being replayed.
+	MaxAge time.Duration
+
+	// Size at which the current segment will be closed and a new segment
+	// will be started.
+	SegmentBytes int64
+}
+
+// Returns the default settings for the spool. The directory must be set
+// explicitly.
+func DefaultSpoolOptions() SpoolOptions {
+	return SpoolOptions{
+		MaxBytes:     100 * 1024 * 1024,
+		MaxAge:       time.Hour,
+		SegmentBytes: 4 * 1024 * 1024,
+	}
+}
+
+type spoolSegment struct {
+	seq  uint64
+	path string
+	size int64
+
+	// Time the first record was written. Appends do not change it so the
+	// records in the segment are never older than the max age.
+	created time.Time
+
+	// Position of the next record to replay. It is saved in the metadata
+	// file so records are not sent again after a restart.
+	offset int64
+}
+
+func (seg *spoolSegment) metaPath() string {
+	return strings.TrimSuffix(seg.path, spoolSuffix) + spoolMetaSuffix
+}
+
+// Save the creation time and replay offset for the segment. The data is
+// written to a temporary file and renamed so that a crash cannot leave a
+// partially written file.
+func (seg *spoolSegment) saveMeta() error {
+	data := make([]byte, spoolMetaSize)
+	binary.BigEndian.PutUint64(data[0:8], uint64(seg.created.UnixNano()))
+	binary.BigEndian.PutUint64(data[8:16], uint64(seg.offset))
+
+	tmp := seg.metaPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, seg.metaPath())
+}
+
+// Load the creation time and replay offset for the segment. Returns false if
+// the metadata file is missing or invalid.
+func (seg *spoolSegment) loadMeta() bool {
+	data, err := ioutil.ReadFile(seg.metaPath())
+	if err != nil || len(data) != spoolMetaSize {
+		return false
+	}
+	seg.created = time.Unix(0, int64(binary.BigEndian.Uint64(data[0:8])))
+	seg.offset = int64(binary.BigEndian.Uint64(data[8:16]))
+	return true
+}
+
+// Delete the segment and metadata files.
+func (seg *spoolSegment) remove() {
+	os.Remove(seg.path)
+	os.Remove(seg.metaPath())
+}
+
+// Write-ahead spool for payloads that could not be sent to Atlas. Payloads
+// are appended to segment files in the spool directory and can be replayed in
+// the order they were written once the endpoint recovers. The replay position
+// for each segment is kept on disk so a restart will resume where the last
+// replay stopped.
+type Spool struct {
+	options SpoolOptions
+
+	mutex    sync.Mutex
+	segments []*spoolSegment
+	writer   *os.File
+	nextSeq  uint64
+
+	// True while a replay is in progress.
+	replaying bool
+}
+
+// Check that the size and age limits for the spool are valid.
+func checkSpoolOptions(options SpoolOptions) error {
+	if options.MaxBytes <= 0 {
+		return fmt.Errorf("spool max bytes must be positive: %d", options.MaxBytes)
+	}
+	if options.SegmentBytes <= 0 {
+		return fmt.Errorf("spool segment bytes must be positive: %d", options.SegmentBytes)
+	}
+	if options.MaxAge < 0 {
+		return fmt.Errorf("spool max age must not be negative: %v", options.MaxAge)
+	}
+	return nil
+}
+
+// Open the spool in the directory, creating the directory if needed. Existing
+// segments will be checked and truncated after the last valid record if they
+// are corrupt. Segments that were already fully replayed are removed.
+func OpenSpool(options SpoolOptions) (*Spool, error) {
+	if options.Dir == "" {
+		return nil, errors.New("spool directory must be specified")
+	}
+	if err := checkSpoolOptions(options); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(options.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(options.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{options: options}
+	seqs := make(map[uint64]bool)
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, spoolSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		path := filepath.Join(options.Dir, name)
+		size, err := checkSegment(path)
+		if err != nil {
+			return nil, err
+		}
+		seg := &spoolSegment{seq: seq, path: path, size: size}
+		if !seg.loadMeta() {
+			// Metadata is missing, the modification time is the best
+			// estimate available for the age
+			seg.created = f.ModTime()
+			seg.offset = 0
+		}
+		if seg.offset >= size {
+			seg.remove()
+			continue
+		}
+		s.segments = append(s.segments, seg)
+		seqs[seq] = true
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+	sort.Sort(segmentsBySeq(s.segments))
+
+	// Remove metadata for segments that no longer exist, e.g. if the process
+	// stopped while a segment was being created or removed
+	for _, f := range files {
+		name := f.Name()
+		base := strings.TrimSuffix(name, ".tmp")
+		if f.IsDir() || !strings.HasSuffix(base, spoolMetaSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(base, spoolMetaSuffix), 10, 64)
+		if err == nil && !seqs[seq] {
+			os.Remove(filepath.Join(options.Dir, name))
+		}
+	}
+	return s, nil
+}
+
+type segmentsBySeq []*spoolSegment
+
+func (s segmentsBySeq) Len() int           { return len(s) }
+func (s segmentsBySeq) Less(i, j int) bool { return s[i].seq < s[j].seq }
+func (s segmentsBySeq) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Verify all records in a segment. If a corrupt record is found, then the
+// segment is truncated so that it only contains the valid records before it.
+// Returns the size of the valid portion of the segment.
+func checkSegment(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var size int64
+	for {
+		payload, err := readRecord(reader)
+		if err == io.EOF {
+			return size, nil
+		} else if err == errCorruptRecord {
+			logger := log.New()
+			logger.Warnf("corrupt record in spool segment %s at offset %d, truncating", path, size)
+			return size, os.Truncate(path, size)
+		} else if err != nil {
+			return 0, err
+		}
+		size += int64(spoolHeaderSize + len(payload))
+	}
+}
+
+// Write a single record with the header.
+func writeRecord(w io.Writer, payload []byte) error {
+	header := make([]byte, spoolHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// Read a single record. Returns io.EOF if there are no more records or
+// errCorruptRecord if the record is truncated or the checksum does not match.
+func readRecord(r io.Reader) ([]byte, error) {
+	header := make([]byte, spoolHeaderSize)
+	if _, err := io.ReadFull(r, header); err == io.EOF {
+		return nil, io.EOF
+	} else if err == io.ErrUnexpectedEOF {
+		return nil, errCorruptRecord
+	} else if err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > spoolMaxRecordSize {
+		return nil, errCorruptRecord
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errCorruptRecord
+	} else if err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errCorruptRecord
+	}
+	return payload, nil
+}
+
+// Total number of bytes used by the segments.
+func (s *Spool) Size() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.size()
+}
+
+func (s *Spool) size() int64 {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// Close the segment that is currently being written so that it can be
+// replayed. Must be called with the lock held.
+func (s *Spool) closeWriter() error {
+	if s.writer == nil {
+		return nil
+	}
+	err := s.writer.Close()
+	s.writer = nil
+	return err
+}
+
+// Remove the oldest segment. Must be called with the lock held.
+func (s *Spool) removeOldest() {
+	seg := s.segments[0]
+	if len(s.segments) == 1 {
+		s.closeWriter()
+	}
+	seg.remove()
+	s.segments = s.segments[1:]
+}
+
+// Discard segments that are older than the max age. Must be called with the
+// lock held.
+func (s *Spool) expire(now time.Time) {
+	logger := log.New()
+	for len(s.segments) > 0 && s.options.MaxAge > 0 && now.Sub(s.segments[0].created) > s.options.MaxAge {
+		logger.Warnf("discarding expired spool segment %s", s.segments[0].path)
+		s.removeOldest()
+	}
+}
+
+// Append a payload to the spool. The oldest segments will be discarded if
+// needed to stay within the size limit.
+func (s *Spool) Append(payload []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	recordSize := int64(spoolHeaderSize + len(payload))
+	if recordSize > s.options.MaxBytes {
+		return fmt.Errorf("payload of %d bytes exceeds the spool limit of %d bytes", len(payload), s.options.MaxBytes)
+	}
+
+	now := time.Now()
+	s.expire(now)
+
+	logger := log.New()
+	for len(s.segments) > 0 && s.size()+recordSize > s.options.MaxBytes {
+		logger.Warnf("spool is full, discarding segment %s", s.segments[0].path)
+		s.removeOldest()
+	}
+
+	if s.writer == nil || s.segments[len(s.segments)-1].size >= s.options.SegmentBytes {
+		if err := s.rotate(now); err != nil {
+			return err
+		}
+	}
+
+	seg := s.segments[len(s.segments)-1]
+	if err := writeRecord(s.writer, payload); err != nil {
+		return err
+	}
+	if err := s.writer.Sync(); err != nil {
+		return err
+	}
+	seg.size += recordSize
+	return nil
+}
+
+// Start a new segment for writing. Must be called with the lock held.
+func (s *Spool) rotate(now time.Time) error {
+	if err := s.closeWriter(); err != nil {
+		return err
+	}
+
+	// A new segment is only started when a record is about to be written so
+	// the current time is used for the first record
+	path := filepath.Join(s.options.Dir, fmt.Sprintf("%020d%s", s.nextSeq, spoolSuffix))
+	seg := &spoolSegment{seq: s.nextSeq, path: path, created: now}
+	if err := seg.saveMeta(); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		os.Remove(seg.metaPath())
+		return err
+	}
+	s.writer = file
+	s.segments = append(s.segments, seg)
+	s.nextSeq++
+	return nil
+}
+
+// Send the spooled payloads in the order they were written. Replay stops at
+// the first payload that fails with a retryable error so it can be retried
+// later. Payloads that fail with a permanent error, such as a 400 response,
+// would fail the same way on every attempt so they are dropped. Segments are
+// removed once all of the payloads in them have been processed. The lock is
+// not held while sending so payloads can be appended concurrently. Returns
+// the number of payloads that were sent.
+func (s *Spool) Replay(send func([]byte) error) (int, error) {
+	s.mutex.Lock()
+	if s.replaying {
+		s.mutex.Unlock()
+		return 0, nil
+	}
+	s.expire(time.Now())
+	if err := s.closeWriter(); err != nil {
+		s.mutex.Unlock()
+		return 0, err
+	}
+
+	// Only the segments that exist now are replayed. Payloads appended while
+	// replaying go to a new segment and will be sent on the next call.
+	pending := make([]*spoolSegment, len(s.segments))
+	copy(pending, s.segments)
+	s.replaying = true
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		s.replaying = false
+		s.mutex.Unlock()
+	}()
+
+	sent := 0
+	for _, seg := range pending {
+		n, err := s.replaySegment(seg, send)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+		s.mutex.Lock()
+		s.removeSegment(seg)
+		s.mutex.Unlock()
+	}
+	return sent, nil
+}
+
+// Returns true if the segment has not been discarded. Must be called with the
+// lock held.
+func (s *Spool) hasSegment(seg *spoolSegment) bool {
+	for _, other := range s.segments {
+		if other == seg {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the segment if it has not already been discarded. Must be called
+// with the lock held.
+func (s *Spool) removeSegment(seg *spoolSegment) {
+	for i, other := range s.segments {
+		if other == seg {
+			seg.remove()
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			return
+		}
+	}
+}
+
+// Send the remaining payloads for a single segment. The lock is only held
+// to read and update the offset so it must not be held by the caller. The
+// offset is saved after each payload so it will not be sent again if the
+// process restarts.
+func (s *Spool) replaySegment(seg *spoolSegment, send func([]byte) error) (int, error) {
+	logger := log.New()
+
+	s.mutex.Lock()
+	offset := seg.offset
+	s.mutex.Unlock()
+
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, 0); err != nil {
+		return 0, err
+	}
+
+	reader := bufio.NewReader(file)
+	sent := 0
+	for {
+		payload, err := readRecord(reader)
+		if err == io.EOF {
+			return sent, nil
+		} else if err == errCorruptRecord {
+			logger.Warnf("corrupt record in spool segment %s at offset %d, skipping remainder", seg.path, offset)
+			return sent, nil
+		} else if err != nil {
+			return sent, err
+		}
+
+		err = send(payload)
+		if err == errCorruptRecord || (err != nil && !isRetryable(err)) {
+			logger.Warnf("dropping spooled payload in %s at offset %d: %v", seg.path, offset, err)
+		} else if err != nil {
+			return sent, err
+		} else {
+			sent++
+		}
+
+		offset += int64(spoolHeaderSize + len(payload))
+		s.mutex.Lock()
+		discarded := !s.hasSegment(seg)
+		seg.offset = offset
+		if !discarded {
+			if err := seg.saveMeta(); err != nil {
+				logger.Warnf("failed to save replay offset for spool segment %s: %v", seg.path, err)
+			}
+		}
+		s.mutex.Unlock()
+		if discarded {
+			return sent, nil
+		}
+	}
+}
+
+// Close the spool. Any segments that have not been replayed will remain on
+// disk and will be picked up the next time the spool is opened.
+func (s *Spool) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closeWriter()
+}
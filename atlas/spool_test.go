@@ -0,0 +1,479 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Replay the spool and return the payloads as strings.
+func replayAll(s *Spool) []string {
+	var payloads []string
+	s.Replay(func(data []byte) error {
+		payloads = append(payloads, string(data))
+		return nil
+	})
+	return payloads
+}
+
+func spoolFiles(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	return files
+}
+
+func TestSpool(t *testing.T) {
+
+	options := SpoolOptions{
+		MaxBytes:     1024,
+		MaxAge:       time.Hour,
+		SegmentBytes: 32,
+	}
+
+	newSpool := func() (*Spool, string) {
+		dir, err := ioutil.TempDir("", "atlas-spool")
+		if err != nil {
+			panic(err)
+		}
+		opts := options
+		opts.Dir = dir
+		s, err := OpenSpool(opts)
+		if err != nil {
+			panic(err)
+		}
+		return s, dir
+	}
+
+	Convey("readRecord and writeRecord", t, func() {
+		var buffer bytes.Buffer
+		So(writeRecord(&buffer, []byte("foo")), ShouldBeNil)
+		So(writeRecord(&buffer, []byte("")), ShouldBeNil)
+		So(buffer.Len(), ShouldEqual, 2*spoolHeaderSize+3)
+
+		data := buffer.Bytes()
+		reader := bytes.NewReader(data)
+		payload, err := readRecord(reader)
+		So(err, ShouldBeNil)
+		So(string(payload), ShouldEqual, "foo")
+		payload, err = readRecord(reader)
+		So(err, ShouldBeNil)
+		So(string(payload), ShouldEqual, "")
+		_, err = readRecord(reader)
+		So(err, ShouldEqual, io.EOF)
+
+		// Truncated
+		_, err = readRecord(bytes.NewReader(data[:spoolHeaderSize+1]))
+		So(err, ShouldEqual, errCorruptRecord)
+		_, err = readRecord(bytes.NewReader(data[:4]))
+		So(err, ShouldEqual, errCorruptRecord)
+
+		// Checksum mismatch
+		corrupt := append([]byte{}, data...)
+		corrupt[spoolHeaderSize] = 'g'
+		_, err = readRecord(bytes.NewReader(corrupt))
+		So(err, ShouldEqual, errCorruptRecord)
+	})
+
+	Convey("OpenSpool requires a directory", t, func() {
+		_, err := OpenSpool(DefaultSpoolOptions())
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("OpenSpool requires valid limits", t, func() {
+		dir, _ := ioutil.TempDir("", "atlas-spool")
+		defer os.RemoveAll(dir)
+
+		opts := options
+		opts.Dir = dir
+		opts.MaxBytes = 0
+		_, err := OpenSpool(opts)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("append and replay in order", t, func() {
+		s, dir := newSpool()
+		defer os.RemoveAll(dir)
+
+		for i := 0; i < 10; i++ {
+			So(s.Append([]byte(fmt.Sprintf("payload-%d", i))), ShouldBeNil)
+		}
+
+		// Segments are rotated when they exceed the segment size
+		So(len(spoolFiles(dir)), ShouldEqual, 5)
+
+		expected := make([]string, 10)
+		for i := range expected {
+			expected[i] = fmt.Sprintf("payload-%d", i)
+		}
+		So(replayAll(s), ShouldResemble, expected)
+		So(s.Size(), ShouldEqual, 0)
+		So(spoolFiles(dir), ShouldBeEmpty)
+
+		// Spool can be reused after replay
+		So(s.Append([]byte("after")), ShouldBeNil)
+		So(replayAll(s), ShouldResemble, []string{"after"})
+	})
+
+	Convey("replay resumes after failure", t, func() {
+		s, dir := newSpool()
+		defer os.RemoveAll(dir)
+
+		for i := 0; i < 4; i++ {
+			So(s.Append([]byte(fmt.Sprintf("payload-%d", i))), ShouldBeNil)
+		}
+
+		var payloads []string
+		n, err := s.Replay(func(data []byte) error {
+			if len(payloads) == 1 {
+				return &httpError{503, "unavailable", 0}
+			}
+			payloads = append(payloads, string(data))
+			return nil
+		})
+		So(n, ShouldEqual, 1)
+		So(err, ShouldNotBeNil)
+		So(replayAll(s), ShouldResemble, []string{"payload-1", "payload-2", "payload-3"})
+	})
+
+	Convey("size limit discards oldest segments", t, func() {
+		s, dir := newSpool()
+		defer os.RemoveAll(dir)
+
+		s.options.MaxBytes = 60
+		for i := 0; i < 10; i++ {
+			So(s.Append([]byte(fmt.Sprintf("payload-%d", i))), ShouldBeNil)
+		}
+		So(s.Size(), ShouldBeLessThanOrEqualTo, 60)
+		So(replayAll(s), ShouldResemble, []string{"payload-8", "payload-9"})
+
+		So(s.Append(make([]byte, 100)), ShouldNotBeNil)
+	})
+
+	Convey("expired segments are discarded", t, func() {
+		s, dir := newSpool()
+		defer os.RemoveAll(dir)
+
+		So(s.Append([]byte("old")), ShouldBeNil)
+		s.segments[0].created = time.Now().Add(-2 * time.Hour)
+		So(s.Append([]byte("new-payload-that-rotates")), ShouldBeNil)
+		So(s.Append([]byte("new")), ShouldBeNil)
+		So(replayAll(s), ShouldResemble, []string{"new-payload-that-rotates", "new"})
+	})
+
+	Convey("appends do not change the age of a segment", t, func() {
+		s, dir := newSpool()
+		defer os.RemoveAll(dir)
+
+		s.options.SegmentBytes = 1024
+		So(s.Append([]byte("first")), ShouldBeNil)
+		created := time.Now().Add(-50 * time.Minute)
+		s.segments[0].created = created
+		So(s.Append([]byte("second")), ShouldBeNil)
+		So(len(s.segments), ShouldEqual, 1)
+		So(s.segments[0].created, ShouldResemble, created)
+
+		// Expired once the first record is older than the max age even
+		// though records were appended recently
+		s.segments[0].created = time.Now().Add(-2 * time.Hour)
+		So(s.Append([]byte("third")), ShouldBeNil)
+		So(replayAll(s), ShouldResemble, []string{"third"})
+	})
+
+	Convey("reopen spool", t, func() {
+		s, dir := newSpool()
+		defer os.RemoveAll(dir)
+
+		for i := 0; i < 4; i++ {
+			So(s.Append([]byte(fmt.Sprintf("payload-%d", i))), ShouldBeNil)
+		}
+		So(s.Close(), ShouldBeNil)
+
+		opts := options
+		opts.Dir = dir
+		s, err := OpenSpool(opts)
+		So(err, ShouldBeNil)
+		So(s.Append([]byte("payload-4")), ShouldBeNil)
+		So(replayAll(s), ShouldResemble, []string{"payload-0", "payload-1", "payload-2", "payload-3", "payload-4"})
+	})
+
+	Convey("reopen spool keeps the age of segments", t, func() {
+		s, dir := newSpool()
+		defer os.RemoveAll(dir)
+
+		So(s.Append([]byte("payload-0")), ShouldBeNil)
+		created := s.segments[0].created
+		So(s.Close(), ShouldBeNil)
+
+		opts := options
+		opts.Dir = dir
+		s, err := OpenSpool(opts)
+		So(err, ShouldBeNil)
+		So(len(s.segments), ShouldEqual, 1)
+		So(s.segments[0].created.UnixNano(), ShouldEqual, created.UnixNano())
+	})
+
+	Convey("reopen spool resumes a partial replay", t, func() {
+		s, dir := newSpool()
+		defer os.RemoveAll(dir)
+
+		for i := 0; i < 4; i++ {
+			So(s.Append([]byte(fmt.Sprintf("payload-%d", i))), ShouldBeNil)
+		}
+
+		var payloads []string
+		_, err := s.Replay(func(data []byte) error {
+			if len(payloads) == 1 {
+				return &httpError{503, "unavailable", 0}
+			}
+			payloads = append(payloads, string(data))
+			return nil
+		})
+		So(err, ShouldNotBeNil)
+		So(payloads, ShouldResemble, []string{"payload-0"})
+		So(s.Close(), ShouldBeNil)
+
+		// Records that were already sent are not replayed again
+		opts := options
+		opts.Dir = dir
+		s, err = OpenSpool(opts)
+		So(err, ShouldBeNil)
+		So(replayAll(s), ShouldResemble, []string{"payload-1", "payload-2", "payload-3"})
+		So(s.Close(), ShouldBeNil)
+
+		metaFiles, _ := filepath.Glob(filepath.Join(dir, "*"+spoolMetaSuffix))
+		So(metaFiles, ShouldBeEmpty)
+
+		s, err = OpenSpool(opts)
+		So(err, ShouldBeNil)
+		So(replayAll(s), ShouldBeEmpty)
+	})
+
+	Convey("reopen spool removes fully replayed segments and stale metadata", t, func() {
+		s, dir := newSpool()
+		defer os.RemoveAll(dir)
+
+		So(s.Append([]byte("payload-0")), ShouldBeNil)
+		seg := s.segments[0]
+		seg.offset = seg.size
+		So(seg.saveMeta(), ShouldBeNil)
+		So(s.Close(), ShouldBeNil)
+		stale := filepath.Join(dir, fmt.Sprintf("%020d%s", 42, spoolMetaSuffix))
+		So(ioutil.WriteFile(stale, make([]byte, spoolMetaSize), 0644), ShouldBeNil)
+
+		opts := options
+		opts.Dir = dir
+		s, err := OpenSpool(opts)
+		So(err, ShouldBeNil)
+		So(s.Size(), ShouldEqual, 0)
+		files, _ := ioutil.ReadDir(dir)
+		So(files, ShouldBeEmpty)
+	})
+
+	Convey("corrupt segment is truncated on open", t, func() {
+		s, dir := newSpool()
+		defer os.RemoveAll(dir)
+
+		s.options.SegmentBytes = 1024
+		for i := 0; i < 3; i++ {
+			So(s.Append([]byte(fmt.Sprintf("payload-%d", i))), ShouldBeNil)
+		}
+		So(s.Close(), ShouldBeNil)
+
+		// Simulate a partial write at the end of the segment
+		files := spoolFiles(dir)
+		So(len(files), ShouldEqual, 1)
+		file, _ := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0644)
+		file.Write([]byte{0, 0, 0, 42, 1, 2})
+		file.Close()
+
+		opts := options
+		opts.Dir = dir
+		s, err := OpenSpool(opts)
+		So(err, ShouldBeNil)
+		So(s.Size(), ShouldEqual, 3*(spoolHeaderSize+len("payload-0")))
+		So(replayAll(s), ShouldResemble, []string{"payload-0", "payload-1", "payload-2"})
+	})
+
+	Convey("client spools failed batches and replays when available", t, func() {
+		dir, _ := ioutil.TempDir("", "atlas-spool")
+		defer os.RemoveAll(dir)
+		opts := DefaultSpoolOptions()
+		opts.Dir = dir
+		spool, err := OpenSpool(opts)
+		So(err, ShouldBeNil)
+
+		available := false
+		var received []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !available {
+				w.WriteHeader(503)
+				return
+			}
+			var batch metricBatch
+			json.NewDecoder(r.Body).Decode(&batch)
+			for _, m := range batch.Metrics {
+				received = append(received, m.Tags["name"])
+			}
+		}))
+		defer server.Close()
+
+		clientOptions := DefaultClientOptions()
+		clientOptions.Retry.MaxAttempts = 1
+		clientOptions.Spool = spool
+		client := NewAtlasClientWithOptions(server.URL, map[string]string{}, clientOptions)
+
+		// Publish does not fail if all of the failed batches were spooled
+		So(client.Publish([]Metric{Metric{map[string]string{"name": "a"}, 0, 1.0}}), ShouldBeNil)
+		So(spool.Size(), ShouldBeGreaterThan, 0)
+
+		So(client.Publish([]Metric{Metric{map[string]string{"name": "b"}, 0, 1.0}}), ShouldBeNil)
+		So(received, ShouldBeEmpty)
+
+		available = true
+		So(client.Publish([]Metric{Metric{map[string]string{"name": "c"}, 0, 1.0}}), ShouldBeNil)
+		So(received, ShouldResemble, []string{"a", "b", "c"})
+		So(spool.Size(), ShouldEqual, 0)
+	})
+
+	Convey("spooled batch failure", t, func() {
+		failure := newBatchFailure(0, 2, &spooledError{&httpError{503, "", 0}})
+		So(failure.Spooled, ShouldBeTrue)
+		So(failure.Dropped, ShouldEqual, 0)
+		So(failure.StatusCode, ShouldEqual, 503)
+		So(allSpooled([]BatchFailure{failure}), ShouldBeTrue)
+		So(allSpooled([]BatchFailure{failure, newBatchFailure(1, 2, &httpError{400, "", 0})}), ShouldBeFalse)
+	})
+
+	Convey("replay drops payloads with a permanent failure", t, func() {
+		s, dir := newSpool()
+		defer os.RemoveAll(dir)
+
+		for i := 0; i < 3; i++ {
+			So(s.Append([]byte(fmt.Sprintf("payload-%d", i))), ShouldBeNil)
+		}
+
+		var attempts []string
+		n, err := s.Replay(func(data []byte) error {
+			attempts = append(attempts, string(data))
+			if string(data) == "payload-0" {
+				return &httpError{400, "invalid", 0}
+			}
+			return nil
+		})
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 2)
+		So(attempts, ShouldResemble, []string{"payload-0", "payload-1", "payload-2"})
+		So(s.Size(), ShouldEqual, 0)
+		So(replayAll(s), ShouldBeEmpty)
+	})
+
+	Convey("replay stops at retryable failure", t, func() {
+		s, dir := newSpool()
+		defer os.RemoveAll(dir)
+
+		So(s.Append([]byte("payload-0")), ShouldBeNil)
+		So(s.Append([]byte("payload-1")), ShouldBeNil)
+
+		n, err := s.Replay(func(data []byte) error {
+			return &httpError{503, "unavailable", 0}
+		})
+		So(err, ShouldNotBeNil)
+		So(n, ShouldEqual, 0)
+		So(replayAll(s), ShouldResemble, []string{"payload-0", "payload-1"})
+	})
+
+	Convey("replay does not hold the lock while sending", t, func() {
+		s, dir := newSpool()
+		defer os.RemoveAll(dir)
+
+		So(s.Append([]byte("payload-0")), ShouldBeNil)
+		n, err := s.Replay(func(data []byte) error {
+			// Would deadlock if the lock was held
+			return s.Append([]byte("appended"))
+		})
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+
+		// Payloads appended during the replay are sent on the next call
+		So(replayAll(s), ShouldResemble, []string{"appended"})
+	})
+
+	Convey("client skips invalid spooled payloads", t, func() {
+		dir, _ := ioutil.TempDir("", "atlas-spool")
+		defer os.RemoveAll(dir)
+		opts := DefaultSpoolOptions()
+		opts.Dir = dir
+		spool, err := OpenSpool(opts)
+		So(err, ShouldBeNil)
+		So(spool.Append([]byte("{")), ShouldBeNil)
+
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+		}))
+		defer server.Close()
+
+		clientOptions := DefaultClientOptions()
+		clientOptions.Spool = spool
+		client := NewAtlasClientWithOptions(server.URL, map[string]string{}, clientOptions)
+		So(client.Publish([]Metric{Metric{map[string]string{"name": "a"}, 0, 1.0}}), ShouldBeNil)
+		So(requests, ShouldEqual, 1)
+		So(spool.Size(), ShouldEqual, 0)
+	})
+
+	Convey("client drops spooled payloads rejected by the server", t, func() {
+		dir, _ := ioutil.TempDir("", "atlas-spool")
+		defer os.RemoveAll(dir)
+		opts := DefaultSpoolOptions()
+		opts.Dir = dir
+		spool, err := OpenSpool(opts)
+		So(err, ShouldBeNil)
+		So(spool.Append([]byte(`{"tags":{},"metrics":[{"tags":{"name":"bad"},"timestamp":0,"value":1}]}`)), ShouldBeNil)
+
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			var batch metricBatch
+			json.NewDecoder(r.Body).Decode(&batch)
+			if batch.Metrics[0].Tags["name"] == "bad" {
+				w.WriteHeader(400)
+			}
+		}))
+		defer server.Close()
+
+		clientOptions := DefaultClientOptions()
+		clientOptions.Spool = spool
+		client := NewAtlasClientWithOptions(server.URL, map[string]string{}, clientOptions)
+		for i := 0; i < 3; i++ {
+			So(client.Publish([]Metric{Metric{map[string]string{"name": "a"}, 0, 1.0}}), ShouldBeNil)
+		}
+
+		// Rejected payload is only sent once
+		So(requests, ShouldEqual, 4)
+		So(spool.Size(), ShouldEqual, 0)
+	})
+}
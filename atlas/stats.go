@@ -0,0 +1,226 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default interval for sending the self-metrics about the publisher. They are
+// disabled by default so existing tasks do not start sending new series.
+const defaultSelfMetricsInterval = 0
+
+// Value of the id tag used for the self-metrics about the publisher.
+const selfMetricsID = "atlas-publisher"
+
+// Reasons for datapoints being dropped before they are sent.
+const (
+	dropNonNumeric = "nonNumeric"
+	dropNaN        = "nan"
+	dropExcluded   = "excluded"
+	dropInvalid    = "invalid"
+	dropQueueFull  = "queueFull"
+	dropRejected   = "rejected"
+	dropValidation = "validation"
+)
+
+// Identifies a counter tracked by the stats. Each counter has a name and a
+// single dimension.
+type statID struct {
+	name  string
+	key   string
+	value string
+}
+
+type statIDs []statID
+
+func (ids statIDs) Len() int      { return len(ids) }
+func (ids statIDs) Swap(i, j int) { ids[i], ids[j] = ids[j], ids[i] }
+func (ids statIDs) Less(i, j int) bool {
+	a, b := ids[i], ids[j]
+	if a.name != b.name {
+		return a.name < b.name
+	}
+	if a.key != b.key {
+		return a.key < b.key
+	}
+	return a.value < b.value
+}
+
+// Counters for the datapoints processed and payloads sent by a client. It is
+// safe to update the stats from multiple goroutines.
+type ClientStats struct {
+	payloadBytes uint64
+	sentBytes    uint64
+
+	mutex      sync.Mutex
+	counters   map[statID]float64
+	maxLatency time.Duration
+
+	// State as of the last time the self-metrics were generated.
+	lastEmit time.Time
+	previous map[statID]float64
+}
+
+// Record a payload that was sent. The payload size is the number of bytes
+// for the encoded json and the sent size is the number of bytes in the
+// request body after compression.
+func (s *ClientStats) recordPayload(payloadSize, sentSize int) {
+	atomic.AddUint64(&s.payloadBytes, uint64(payloadSize))
+	atomic.AddUint64(&s.sentBytes, uint64(sentSize))
+}
+
+// Total number of bytes for the encoded json payloads.
+func (s *ClientStats) PayloadBytes() uint64 {
+	return atomic.LoadUint64(&s.payloadBytes)
+}
+
+// Total number of bytes sent in request bodies.
+func (s *ClientStats) SentBytes() uint64 {
+	return atomic.LoadUint64(&s.sentBytes)
+}
+
+// Total number of bytes saved by compressing the payloads.
+func (s *ClientStats) BytesSaved() uint64 {
+	payload := s.PayloadBytes()
+	sent := s.SentBytes()
+	if sent > payload {
+		return 0
+	}
+	return payload - sent
+}
+
+func (s *ClientStats) increment(id statID, amount float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.counters == nil {
+		s.counters = make(map[statID]float64)
+	}
+	s.counters[id] += amount
+}
+
+// Record datapoints received from snap.
+func (s *ClientStats) recordReceived(n int) {
+	s.increment(statID{"atlas.publisher.datapoints", "stage", "received"}, float64(n))
+}
+
+// Record datapoints after conversion to the Atlas data model.
+func (s *ClientStats) recordConverted(n int) {
+	s.increment(statID{"atlas.publisher.datapoints", "stage", "converted"}, float64(n))
+}
+
+// Record datapoints that were dropped before being sent.
+func (s *ClientStats) recordDropped(reason string, n int) {
+	if n > 0 {
+		s.increment(statID{"atlas.publisher.dropped", "reason", reason}, float64(n))
+	}
+}
+
+// Record a failure to open the spool.
+func (s *ClientStats) recordSpoolError() {
+	s.increment(statID{"atlas.publisher.spoolErrors", "operation", "open"}, 1)
+}
+
+// Record the outcome for a batch.
+func (s *ClientStats) recordBatch(success bool) {
+	status := "success"
+	if !success {
+		status = "failure"
+	}
+	s.increment(statID{"atlas.publisher.batches", "status", status}, 1)
+}
+
+// Record a single HTTP request. The status code should be 0 if no response
+// was received.
+func (s *ClientStats) recordRequest(statusCode int, latency time.Duration) {
+	status := "error"
+	if statusCode > 0 {
+		status = strconv.Itoa(statusCode)
+	}
+	s.increment(statID{"atlas.publisher.requests", "statusCode", status}, 1)
+	s.increment(statID{"atlas.publisher.requestLatency", "statistic", "count"}, 1)
+	s.increment(statID{"atlas.publisher.requestLatency", "statistic", "totalTime"}, latency.Seconds())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if latency > s.maxLatency {
+		s.maxLatency = latency
+	}
+}
+
+// Generate the self-metrics about the publisher if at least the interval has
+// passed since they were last generated. Counters are reported as a rate per
+// second over the time since the previous call. The first call only records
+// the start time and returns nil.
+func (s *ClientStats) selfMetrics(now time.Time, interval time.Duration) []Metric {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.lastEmit.IsZero() {
+		s.lastEmit = now
+		return nil
+	}
+	elapsed := now.Sub(s.lastEmit)
+	if elapsed < interval || elapsed <= 0 {
+		return nil
+	}
+
+	current := make(map[statID]float64, len(s.counters)+2)
+	for id, v := range s.counters {
+		current[id] = v
+	}
+	current[statID{"atlas.publisher.bytes", "stage", "payload"}] = float64(s.PayloadBytes())
+	current[statID{"atlas.publisher.bytes", "stage", "sent"}] = float64(s.SentBytes())
+
+	ids := make([]statID, 0, len(current))
+	for id := range current {
+		ids = append(ids, id)
+	}
+	sort.Sort(statIDs(ids))
+
+	timestamp := uint64(now.UnixNano() / int64(time.Millisecond))
+	seconds := elapsed.Seconds()
+	metrics := make([]Metric, 0, len(ids)+1)
+	for _, id := range ids {
+		tags := map[string]string{
+			"name":    id.name,
+			id.key:    id.value,
+			"id":      selfMetricsID,
+			dstypeTag: "rate",
+		}
+		delta := current[id] - s.previous[id]
+		metrics = append(metrics, Metric{tags, timestamp, delta / seconds})
+	}
+
+	if s.maxLatency > 0 {
+		tags := map[string]string{
+			"name":      "atlas.publisher.requestLatency",
+			"statistic": "max",
+			"id":        selfMetricsID,
+			dstypeTag:   "gauge",
+		}
+		metrics = append(metrics, Metric{tags, timestamp, s.maxLatency.Seconds()})
+		s.maxLatency = 0
+	}
+
+	s.lastEmit = now
+	s.previous = current
+	return metrics
+}
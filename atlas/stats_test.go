@@ -0,0 +1,91 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStats(t *testing.T) {
+
+	Convey("ClientStats", t, func() {
+		stats := &ClientStats{}
+		So(stats.PayloadBytes(), ShouldEqual, 0)
+		So(stats.SentBytes(), ShouldEqual, 0)
+		So(stats.BytesSaved(), ShouldEqual, 0)
+
+		stats.recordPayload(100, 20)
+		stats.recordPayload(50, 10)
+		So(stats.PayloadBytes(), ShouldEqual, 150)
+		So(stats.SentBytes(), ShouldEqual, 30)
+		So(stats.BytesSaved(), ShouldEqual, 120)
+	})
+
+	Convey("selfMetrics", t, func() {
+		stats := &ClientStats{}
+		start := time.Unix(1000, 0)
+
+		// First call records the start time
+		So(stats.selfMetrics(start, time.Minute), ShouldBeNil)
+
+		stats.recordReceived(120)
+		stats.recordConverted(60)
+		stats.recordDropped(dropNonNumeric, 30)
+		stats.recordDropped(dropExcluded, 0)
+		stats.recordBatch(true)
+		stats.recordBatch(false)
+		stats.recordRequest(200, 2*time.Second)
+		stats.recordRequest(0, 4*time.Second)
+		stats.recordPayload(600, 300)
+
+		// Interval has not yet passed
+		So(stats.selfMetrics(start.Add(30*time.Second), time.Minute), ShouldBeNil)
+
+		now := start.Add(time.Minute)
+		tags := func(name, k, v, dstype string) map[string]string {
+			return map[string]string{"name": name, k: v, "id": "atlas-publisher", "atlas.dstype": dstype}
+		}
+		So(stats.selfMetrics(now, time.Minute), ShouldResemble, []Metric{
+			Metric{tags("atlas.publisher.batches", "status", "failure", "rate"), 1060000, 1.0 / 60.0},
+			Metric{tags("atlas.publisher.batches", "status", "success", "rate"), 1060000, 1.0 / 60.0},
+			Metric{tags("atlas.publisher.bytes", "stage", "payload", "rate"), 1060000, 10.0},
+			Metric{tags("atlas.publisher.bytes", "stage", "sent", "rate"), 1060000, 5.0},
+			Metric{tags("atlas.publisher.datapoints", "stage", "converted", "rate"), 1060000, 1.0},
+			Metric{tags("atlas.publisher.datapoints", "stage", "received", "rate"), 1060000, 2.0},
+			Metric{tags("atlas.publisher.dropped", "reason", "nonNumeric", "rate"), 1060000, 0.5},
+			Metric{tags("atlas.publisher.requestLatency", "statistic", "count", "rate"), 1060000, 2.0 / 60.0},
+			Metric{tags("atlas.publisher.requestLatency", "statistic", "totalTime", "rate"), 1060000, 0.1},
+			Metric{tags("atlas.publisher.requests", "statusCode", "200", "rate"), 1060000, 1.0 / 60.0},
+			Metric{tags("atlas.publisher.requests", "statusCode", "error", "rate"), 1060000, 1.0 / 60.0},
+			Metric{tags("atlas.publisher.requestLatency", "statistic", "max", "gauge"), 1060000, 4.0},
+		})
+
+		// Rates are computed from the change since the previous call
+		stats.recordReceived(60)
+		metrics := stats.selfMetrics(now.Add(time.Minute), time.Minute)
+		So(len(metrics), ShouldEqual, 11)
+		for _, m := range metrics {
+			if m.Tags["stage"] == "received" {
+				So(m.Value, ShouldEqual, 1.0)
+			} else {
+				So(m.Value, ShouldEqual, 0.0)
+			}
+		}
+	})
+}
@@ -0,0 +1,290 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Maximum number of parsed templates to keep in a cache. If exceeded, then
+// the cache is reset.
+const maxCachedTemplates = 1000
+
+// Function that can be applied to the value of a template variable.
+type templateFunc func(string) string
+
+// Parse a function used in a template expression, e.g.: lower, upper, or
+// replace(old,new).
+func parseTemplateFunc(s string) (templateFunc, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "lower":
+		return strings.ToLower, nil
+	case s == "upper":
+		return strings.ToUpper, nil
+	case strings.HasPrefix(s, "replace(") && strings.HasSuffix(s, ")"):
+		args := strings.Split(s[len("replace("):len(s)-1], ",")
+		if len(args) != 2 || args[0] == "" {
+			return nil, fmt.Errorf("replace requires two arguments: replace(old,new)")
+		}
+		return func(v string) string {
+			return strings.Replace(v, args[0], args[1], -1)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown function '%s'", s)
+	}
+}
+
+// Single expression within braces in a template. The supported forms are:
+//
+//	{var}            value of the variable
+//	{var:default}    value of the variable or the default if it is not set
+//	{start:end}      namespace elements in [start, end) joined with '.'
+//	{var|lower}      value with functions applied in order
+type templateExpr struct {
+	// Original text including the braces. Used if the expression cannot be
+	// resolved in non-strict mode.
+	text string
+
+	name       string
+	dflt       string
+	hasDefault bool
+
+	isSlice bool
+	start   int
+	end     int
+
+	funcs []templateFunc
+}
+
+func parseTemplateExpr(text string) (*templateExpr, error) {
+	expr := &templateExpr{text: text}
+	parts := strings.Split(text[1:len(text)-1], "|")
+
+	head := parts[0]
+	if pos := strings.Index(head, ":"); pos >= 0 {
+		expr.name = head[:pos]
+		expr.dflt = head[pos+1:]
+		expr.hasDefault = true
+
+		start, err1 := strconv.Atoi(expr.name)
+		end, err2 := strconv.Atoi(expr.dflt)
+		if err1 == nil && err2 == nil {
+			expr.isSlice = true
+			expr.start = start
+			expr.end = end
+		}
+	} else {
+		expr.name = head
+	}
+	if expr.name == "" {
+		return nil, fmt.Errorf("missing variable name in '%s'", text)
+	}
+
+	for _, f := range parts[1:] {
+		fn, err := parseTemplateFunc(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression '%s': %v", text, err)
+		}
+		expr.funcs = append(expr.funcs, fn)
+	}
+	return expr, nil
+}
+
+// Number of namespace elements based on the positional variables.
+func namespaceLength(vars map[string]string) int {
+	n := 0
+	for {
+		if _, ok := vars[strconv.Itoa(n)]; !ok {
+			return n
+		}
+		n++
+	}
+}
+
+// Normalize an index for a slice so negative values are relative to the end
+// and the result is within [0, n].
+func sliceIndex(i, n int) int {
+	if i < 0 {
+		i += n
+	}
+	if i < 0 {
+		return 0
+	} else if i > n {
+		return n
+	}
+	return i
+}
+
+// Evaluate the expression. Returns false if the variable is not set and
+// there is no default.
+func (e *templateExpr) eval(vars map[string]string) (string, bool) {
+	var value string
+	if e.isSlice {
+		n := namespaceLength(vars)
+		if n == 0 {
+			return "", false
+		}
+		start, end := sliceIndex(e.start, n), sliceIndex(e.end, n)
+		var elements []string
+		for i := start; i < end; i++ {
+			elements = append(elements, vars[strconv.Itoa(i)])
+		}
+		value = strings.Join(elements, ".")
+	} else if v, ok := vars[e.name]; ok {
+		value = v
+	} else if e.hasDefault {
+		value = e.dflt
+	} else {
+		return "", false
+	}
+
+	for _, fn := range e.funcs {
+		value = fn(value)
+	}
+	return value, true
+}
+
+// Parsed template. Each segment is either literal text or an expression.
+type template struct {
+	literals []string
+	exprs    []*templateExpr
+}
+
+// Parse a template. Variables are indicated using braces, e.g.: {varname}.
+// Literal braces can be included by doubling them, e.g.: {{ or }}. A closing
+// brace without a matching open brace is treated as a literal.
+func parseTemplate(s string) (*template, error) {
+	t := &template{}
+	var literal bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '{' && i+1 < len(s) && s[i+1] == '{':
+			literal.WriteByte('{')
+			i++
+		case c == '}' && i+1 < len(s) && s[i+1] == '}':
+			literal.WriteByte('}')
+			i++
+		case c == '{':
+			end := strings.IndexAny(s[i+1:], "{}")
+			if end < 0 || s[i+1+end] != '}' {
+				return nil, fmt.Errorf("unterminated expression at position %d in '%s'", i, s)
+			}
+			expr, err := parseTemplateExpr(s[i : i+end+2])
+			if err != nil {
+				return nil, err
+			}
+			t.literals = append(t.literals, literal.String())
+			t.exprs = append(t.exprs, expr)
+			literal.Reset()
+			i += end + 1
+		default:
+			literal.WriteByte(c)
+		}
+	}
+	t.literals = append(t.literals, literal.String())
+	return t, nil
+}
+
+// Expand the template using the vars. The expansion is done in a single pass
+// so values that contain braces will not be expanded further. In strict
+// mode, an error is returned if a variable is not set and has no default.
+// Otherwise, the expression will be left as is.
+func (t *template) expand(vars map[string]string, strict bool) (string, error) {
+	var buffer bytes.Buffer
+	for i, expr := range t.exprs {
+		buffer.WriteString(t.literals[i])
+		v, ok := expr.eval(vars)
+		if !ok {
+			if strict {
+				return "", fmt.Errorf("unknown variable in '%s'", expr.text)
+			}
+			v = expr.text
+		}
+		buffer.WriteString(v)
+	}
+	buffer.WriteString(t.literals[len(t.literals)-1])
+	return buffer.String(), nil
+}
+
+// Parse and expand a template. If the template is invalid, then in strict
+// mode an error is returned. Otherwise, the pattern is returned unchanged.
+func expandTemplate(pattern string, vars map[string]string, strict bool) (string, error) {
+	t, err := parseTemplate(pattern)
+	if err != nil {
+		if strict {
+			return "", err
+		}
+		return pattern, nil
+	}
+	return t.expand(vars, strict)
+}
+
+// Result of parsing a template that is stored in the cache.
+type parsedTemplate struct {
+	t   *template
+	err error
+}
+
+// Cache of parsed templates for the tag values on metrics. The values are
+// typically the same for every interval, so this avoids parsing them each
+// time a metric is published. It is safe to use from multiple goroutines.
+type templateCache struct {
+	mutex     sync.Mutex
+	templates map[string]parsedTemplate
+}
+
+func newTemplateCache() *templateCache {
+	return &templateCache{templates: make(map[string]parsedTemplate)}
+}
+
+// Get the parsed template for the pattern. Patterns that fail to parse are
+// also cached so the error can be returned without parsing again.
+func (c *templateCache) get(pattern string) (*template, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if p, ok := c.templates[pattern]; ok {
+		return p.t, p.err
+	}
+	if len(c.templates) >= maxCachedTemplates {
+		c.templates = make(map[string]parsedTemplate)
+	}
+	t, err := parseTemplate(pattern)
+	c.templates[pattern] = parsedTemplate{t, err}
+	return t, err
+}
+
+// Same as expandTemplate, but uses the cache for the parsed template. Patterns
+// without braces are returned as is without being parsed.
+func (c *templateCache) expand(pattern string, vars map[string]string, strict bool) (string, error) {
+	if !strings.ContainsAny(pattern, "{}") {
+		return pattern, nil
+	}
+	t, err := c.get(pattern)
+	if err != nil {
+		if strict {
+			return "", err
+		}
+		return pattern, nil
+	}
+	return t.expand(vars, strict)
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/intelsdi-x/snap/core"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTemplate(t *testing.T) {
+
+	vars := map[string]string{
+		"0":    "intel",
+		"1":    "procfs",
+		"2":    "iface",
+		"3":    "eth0",
+		"-1":   "eth0",
+		"host": "I-12345",
+		"a":    "{b}",
+		"b":    "value of b",
+	}
+
+	expand := func(s string, strict bool) string {
+		v, err := expandTemplate(s, vars, strict)
+		So(err, ShouldBeNil)
+		return v
+	}
+
+	Convey("variables", t, func() {
+		So(expand("", true), ShouldEqual, "")
+		So(expand("no vars", true), ShouldEqual, "no vars")
+		So(expand("{host}", true), ShouldEqual, "I-12345")
+		So(expand("{0}.{-1}", true), ShouldEqual, "intel.eth0")
+		So(expand("pre-{host}-post", true), ShouldEqual, "pre-I-12345-post")
+	})
+
+	Convey("single pass expansion", t, func() {
+		for i := 0; i < 10; i++ {
+			So(expand("{a}.{b}", true), ShouldEqual, "{b}.value of b")
+		}
+	})
+
+	Convey("default values", t, func() {
+		So(expand("{host:unknown}", true), ShouldEqual, "I-12345")
+		So(expand("{zone:unknown}", true), ShouldEqual, "unknown")
+		So(expand("{zone:}", true), ShouldEqual, "")
+		So(expand("{zone:a:b}", true), ShouldEqual, "a:b")
+	})
+
+	Convey("escaping", t, func() {
+		So(expand("{{host}}", true), ShouldEqual, "{host}")
+		So(expand("{{{host}}}", true), ShouldEqual, "{I-12345}")
+		So(expand("a}b", true), ShouldEqual, "a}b")
+	})
+
+	Convey("functions", t, func() {
+		So(expand("{host|lower}", true), ShouldEqual, "i-12345")
+		So(expand("{2|upper}", true), ShouldEqual, "IFACE")
+		So(expand("{host|replace(-,_)}", true), ShouldEqual, "I_12345")
+		So(expand("{host|replace(-,)|lower}", true), ShouldEqual, "i12345")
+		So(expand("{zone:US-EAST|lower}", true), ShouldEqual, "us-east")
+	})
+
+	Convey("namespace slices", t, func() {
+		So(expand("{1:3}", true), ShouldEqual, "procfs.iface")
+		So(expand("{0:-1}", true), ShouldEqual, "intel.procfs.iface")
+		So(expand("{-2:4}", true), ShouldEqual, "iface.eth0")
+		So(expand("{2:100}", true), ShouldEqual, "iface.eth0")
+		So(expand("{3:1}", true), ShouldEqual, "")
+		So(expand("{1:3|upper}", true), ShouldEqual, "PROCFS.IFACE")
+
+		_, err := expandTemplate("{1:3}", map[string]string{}, true)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("unknown variables", t, func() {
+		So(expand("{zone}.{host}", false), ShouldEqual, "{zone}.I-12345")
+		So(expand("{zone|lower}", false), ShouldEqual, "{zone|lower}")
+
+		_, err := expandTemplate("{zone}.{host}", vars, true)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("invalid templates", t, func() {
+		invalid := []string{
+			"{host",
+			"{ho{st}",
+			"{}",
+			"{:foo}",
+			"{host|foo}",
+			"{host|replace(a)}",
+			"{host|replace(,b)}",
+		}
+		for _, s := range invalid {
+			_, err := parseTemplate(s)
+			So(err, ShouldNotBeNil)
+			_, err = expandTemplate(s, vars, true)
+			So(err, ShouldNotBeNil)
+
+			// Left unchanged in non-strict mode
+			So(expand(s, false), ShouldEqual, s)
+		}
+	})
+
+	Convey("createAtlasTags with strict templates", t, func() {
+		options := &tagOptions{ignored: ignoredTags, strict: true}
+		ns := core.NewNamespace("intel", "procfs", "cpu")
+
+		actual, err := createAtlasTags(ns, map[string]string{"name": "{1:3|replace(procfs,proc)}"}, options)
+		So(err, ShouldBeNil)
+		So(actual, ShouldResemble, map[string]string{"name": "proc.cpu"})
+
+		_, err = createAtlasTags(ns, map[string]string{"name": "{host}"}, options)
+		So(err, ShouldNotBeNil)
+
+		options.strict = false
+		actual, err = createAtlasTags(ns, map[string]string{"name": "{host}"}, options)
+		So(err, ShouldBeNil)
+		So(actual, ShouldResemble, map[string]string{"name": "{host}"})
+	})
+
+	Convey("templateCache", t, func() {
+		cache := newTemplateCache()
+
+		v, err := cache.expand("{host|lower}", vars, true)
+		So(err, ShouldBeNil)
+		So(v, ShouldEqual, "i-12345")
+		So(len(cache.templates), ShouldEqual, 1)
+
+		// Cached template is reused
+		t1, _ := cache.get("{host|lower}")
+		t2, _ := cache.get("{host|lower}")
+		So(t1, ShouldEqual, t2)
+
+		// Values without braces are not parsed or cached
+		v, err = cache.expand("foo", vars, true)
+		So(err, ShouldBeNil)
+		So(v, ShouldEqual, "foo")
+		So(len(cache.templates), ShouldEqual, 1)
+
+		// Invalid templates are cached with the error
+		_, err = cache.expand("{host", vars, true)
+		So(err, ShouldNotBeNil)
+		v, err = cache.expand("{host", vars, false)
+		So(err, ShouldBeNil)
+		So(v, ShouldEqual, "{host")
+		So(len(cache.templates), ShouldEqual, 2)
+
+		// Reset if there are too many templates
+		for i := 0; i < maxCachedTemplates+1; i++ {
+			cache.get(fmt.Sprintf("{%d}", i))
+		}
+		So(len(cache.templates), ShouldBeLessThanOrEqualTo, maxCachedTemplates)
+	})
+}
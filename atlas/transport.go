@@ -0,0 +1,149 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Settings for the HTTP client used to talk to Atlas.
+type HTTPOptions struct {
+	// Maximum amount of time to wait for a connection to be established.
+	ConnectTimeout time.Duration
+
+	// Maximum amount of time for the overall request including reading
+	// the response body.
+	RequestTimeout time.Duration
+
+	// Maximum number of idle connections to keep in the pool.
+	MaxIdleConns int
+
+	// Interval for TCP keep-alive probes on open connections. A value of 0
+	// disables the probes. It does not impact whether connections are reused.
+	KeepAlive time.Duration
+
+	// If true, then a new connection is used for each request instead of
+	// reusing idle connections from the pool.
+	DisableConnectionReuse bool
+}
+
+// Returns the default settings for the HTTP client.
+func DefaultHTTPOptions() HTTPOptions {
+	return HTTPOptions{
+		ConnectTimeout: 5 * time.Second,
+		RequestTimeout: 30 * time.Second,
+		MaxIdleConns:   10,
+		KeepAlive:      30 * time.Second,
+	}
+}
+
+// Verify the settings are in the supported ranges. The timeouts must be set
+// so that a hung endpoint cannot block publishing indefinitely.
+func checkHTTPOptions(options HTTPOptions) error {
+	if options.ConnectTimeout <= 0 {
+		return fmt.Errorf("connect_timeout_ms must be positive: %d", options.ConnectTimeout/time.Millisecond)
+	}
+	if options.RequestTimeout <= 0 {
+		return fmt.Errorf("request_timeout_ms must be positive: %d", options.RequestTimeout/time.Millisecond)
+	}
+	if options.MaxIdleConns < 0 {
+		return fmt.Errorf("max_idle_conns cannot be negative: %d", options.MaxIdleConns)
+	}
+	if options.KeepAlive < 0 {
+		return fmt.Errorf("keep_alive_ms cannot be negative: %d", options.KeepAlive/time.Millisecond)
+	}
+	return nil
+}
+
+// Create a new HTTP client based on the settings.
+func newHTTPClient(options HTTPOptions) *http.Client {
+	// A negative value is needed to disable the probes since newer versions
+	// of Go use a default interval for 0
+	keepAlive := options.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = -1
+	}
+	dialer := &net.Dialer{
+		Timeout:   options.ConnectTimeout,
+		KeepAlive: keepAlive,
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		Dial:                dialer.Dial,
+		TLSHandshakeTimeout: options.ConnectTimeout,
+		MaxIdleConnsPerHost: options.MaxIdleConns,
+		DisableKeepAlives:   options.DisableConnectionReuse,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   options.RequestTimeout,
+	}
+}
+
+type pooledHTTPClient struct {
+	options HTTPOptions
+	client  *http.Client
+}
+
+// Set of long lived HTTP clients keyed by the URI so that connections can be
+// reused across calls to Publish.
+type httpClientPool struct {
+	mutex   sync.Mutex
+	clients map[string]pooledHTTPClient
+}
+
+func newHTTPClientPool() *httpClientPool {
+	return &httpClientPool{clients: make(map[string]pooledHTTPClient)}
+}
+
+// Get the client for a given URI. If there is no client or the settings have
+// changed, then a new client will be created.
+func (pool *httpClientPool) get(uri string, options HTTPOptions) *http.Client {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if c, ok := pool.clients[uri]; ok {
+		if c.options == options {
+			return c.client
+		}
+		closeIdleConnections(c.client)
+	}
+
+	client := newHTTPClient(options)
+	pool.clients[uri] = pooledHTTPClient{options, client}
+	return client
+}
+
+// Close idle connections for all clients in the pool.
+func (pool *httpClientPool) close() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for uri, c := range pool.clients {
+		closeIdleConnections(c.client)
+		delete(pool.clients, uri)
+	}
+}
+
+func closeIdleConnections(client *http.Client) {
+	if t, ok := client.Transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
+	}
+}
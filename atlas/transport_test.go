@@ -0,0 +1,110 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTransport(t *testing.T) {
+
+	Convey("newHTTPClient", t, func() {
+		client := newHTTPClient(DefaultHTTPOptions())
+		So(client.Timeout, ShouldEqual, 30*time.Second)
+
+		transport := client.Transport.(*http.Transport)
+		So(transport.MaxIdleConnsPerHost, ShouldEqual, 10)
+		So(transport.DisableKeepAlives, ShouldBeFalse)
+
+		// Disabling the TCP keep-alive probes does not disable reuse
+		options := DefaultHTTPOptions()
+		options.KeepAlive = 0
+		transport = newHTTPClient(options).Transport.(*http.Transport)
+		So(transport.DisableKeepAlives, ShouldBeFalse)
+
+		options.DisableConnectionReuse = true
+		transport = newHTTPClient(options).Transport.(*http.Transport)
+		So(transport.DisableKeepAlives, ShouldBeTrue)
+	})
+
+	Convey("checkHTTPOptions", t, func() {
+		So(checkHTTPOptions(DefaultHTTPOptions()), ShouldBeNil)
+
+		options := DefaultHTTPOptions()
+		options.KeepAlive = 0
+		options.MaxIdleConns = 0
+		So(checkHTTPOptions(options), ShouldBeNil)
+
+		invalid := []func(o *HTTPOptions){
+			func(o *HTTPOptions) { o.ConnectTimeout = 0 },
+			func(o *HTTPOptions) { o.ConnectTimeout = -time.Second },
+			func(o *HTTPOptions) { o.RequestTimeout = 0 },
+			func(o *HTTPOptions) { o.RequestTimeout = -time.Second },
+			func(o *HTTPOptions) { o.MaxIdleConns = -1 },
+			func(o *HTTPOptions) { o.KeepAlive = -time.Second },
+		}
+		for _, f := range invalid {
+			options := DefaultHTTPOptions()
+			f(&options)
+			So(checkHTTPOptions(options), ShouldNotBeNil)
+		}
+	})
+
+	Convey("httpClientPool reuses clients", t, func() {
+		pool := newHTTPClientPool()
+		options := DefaultHTTPOptions()
+
+		c1 := pool.get("http://foo/api/v1/publish", options)
+		So(pool.get("http://foo/api/v1/publish", options), ShouldPointTo, c1)
+		So(pool.get("http://bar/api/v1/publish", options), ShouldNotPointTo, c1)
+
+		options.RequestTimeout = time.Second
+		c2 := pool.get("http://foo/api/v1/publish", options)
+		So(c2, ShouldNotPointTo, c1)
+		So(c2.Timeout, ShouldEqual, time.Second)
+
+		pool.close()
+		So(len(pool.clients), ShouldEqual, 0)
+	})
+
+	Convey("request timeout for hung server", t, func() {
+		done := make(chan bool)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-done
+		}))
+		defer server.Close()
+		defer close(done)
+
+		options := DefaultHTTPOptions()
+		options.RequestTimeout = 50 * time.Millisecond
+		clientOptions := DefaultClientOptions()
+		clientOptions.Retry.MaxAttempts = 1
+		clientOptions.HTTPClient = newHTTPClient(options)
+
+		client := NewAtlasClientWithOptions(server.URL, map[string]string{}, clientOptions)
+		start := time.Now()
+		err := client.Publish([]Metric{
+			Metric{map[string]string{"name": "foo"}, 0, 1.0},
+		}).(*PublishError)
+		So(err.Failures[0].StatusCode, ShouldEqual, 0)
+		So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+	})
+}
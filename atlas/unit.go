@@ -0,0 +1,179 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"math"
+	"strings"
+)
+
+// Time units with the number of seconds for each.
+var timeUnits = map[string]float64{
+	"ns":      1e-9,
+	"us":      1e-6,
+	"µs":      1e-6,
+	"ms":      1e-3,
+	"s":       1,
+	"sec":     1,
+	"second":  1,
+	"seconds": 1,
+	"min":     60,
+	"minute":  60,
+	"minutes": 60,
+	"h":       3600,
+	"hour":    3600,
+	"hours":   3600,
+	"d":       86400,
+	"day":     86400,
+	"days":    86400,
+}
+
+// Data units with the number of bits for each.
+var dataUnits = map[string]float64{
+	"b":     1,
+	"bit":   1,
+	"bits":  1,
+	"B":     8,
+	"byte":  8,
+	"bytes": 8,
+}
+
+// Prefixes that can be used with data units or on their own.
+var unitPrefixes = map[string]float64{
+	"k": 1e3,
+	"K": 1e3,
+	"M": 1e6,
+	"G": 1e9,
+	"T": 1e12,
+	"P": 1e15,
+	"E": 1e18,
+	"Z": 1e21,
+	"Y": 1e24,
+
+	"Ki": math.Pow(1024.0, 1),
+	"Mi": math.Pow(1024.0, 2),
+	"Gi": math.Pow(1024.0, 3),
+	"Ti": math.Pow(1024.0, 4),
+	"Pi": math.Pow(1024.0, 5),
+	"Ei": math.Pow(1024.0, 6),
+	"Zi": math.Pow(1024.0, 7),
+	"Yi": math.Pow(1024.0, 8),
+}
+
+// Parsed unit with the factors needed to convert a value to the base unit.
+// The factors are kept separately so that converting sub-units such as
+// milliseconds is done with a division and is exact where possible.
+type unit struct {
+	multiplier float64
+	divisor    float64
+
+	// Normalized name of the unit, e.g. seconds or bytes/second. Empty if
+	// the unit is dimensionless.
+	name string
+
+	// True if the base unit is seconds.
+	time bool
+}
+
+// Convert a value to the base unit.
+func (u unit) convert(v float64) float64 {
+	return v * u.multiplier / u.divisor
+}
+
+// Returns a unit with the scale factor split into a multiplier or divisor.
+func newUnit(scale float64, name string) unit {
+	if scale < 1 {
+		return unit{multiplier: 1, divisor: math.Floor(1/scale + 0.5), name: name}
+	}
+	return unit{multiplier: scale, divisor: 1, name: name}
+}
+
+// Parse a unit that is not a rate. The base unit for time is seconds and
+// for data is bytes or bits.
+func parseSimpleUnit(s string, bits bool) (unit, bool) {
+	switch s {
+	case "", "none":
+		return newUnit(1, ""), true
+	case "%", "percent":
+		return newUnit(1, "percent"), true
+	}
+
+	if seconds, ok := timeUnits[s]; ok {
+		u := newUnit(seconds, "seconds")
+		u.time = true
+		return u, true
+	}
+
+	// Bare prefixes are treated as a dimensionless scale factor
+	if scale, ok := unitPrefixes[s]; ok {
+		return newUnit(scale, ""), true
+	}
+
+	for prefix, scale := range unitPrefixes {
+		if strings.HasPrefix(s, prefix) {
+			if base, ok := dataUnits[s[len(prefix):]]; ok {
+				return dataUnit(scale*base, bits), true
+			}
+		}
+	}
+	if base, ok := dataUnits[s]; ok {
+		return dataUnit(base, bits), true
+	}
+	return unit{}, false
+}
+
+// Create a data unit from the number of bits.
+func dataUnit(numBits float64, bits bool) unit {
+	if bits {
+		return newUnit(numBits, "bits")
+	}
+	return newUnit(numBits/8, "bytes")
+}
+
+// Parse a unit string such as ms, KiB, MB/s, or requests/min. Rates are
+// normalized to per second. For rates, an unknown unit in the numerator is
+// treated as a count, e.g. requests. Returns false if the unit is not
+// recognized.
+func parseUnit(s string, bits bool) (unit, bool) {
+	s = strings.TrimSpace(s)
+	pos := strings.Index(s, "/")
+	if pos < 0 {
+		return parseSimpleUnit(s, bits)
+	}
+
+	seconds, ok := timeUnits[strings.TrimSpace(s[pos+1:])]
+	if !ok {
+		return unit{}, false
+	}
+
+	numerator := strings.TrimSpace(s[:pos])
+	u, ok := parseSimpleUnit(numerator, bits)
+	if !ok || u.name == "" {
+		u = newUnit(1, numerator)
+		if numerator == "" {
+			u.name = "1"
+		}
+	}
+
+	if seconds < 1 {
+		u.multiplier *= math.Floor(1/seconds + 0.5)
+	} else {
+		u.divisor *= seconds
+	}
+	u.name += "/second"
+	u.time = false
+	return u, true
+}
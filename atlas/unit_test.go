@@ -0,0 +1,153 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUnit(t *testing.T) {
+
+	convert := func(s string, bits bool, v float64) (float64, string) {
+		u, ok := parseUnit(s, bits)
+		So(ok, ShouldBeTrue)
+		return u.convert(v), u.name
+	}
+
+	Convey("time units", t, func() {
+		for s, expected := range map[string]float64{
+			"ns": 1e-9, "us": 1e-6, "µs": 1e-6, "ms": 1e-3, "s": 1, "sec": 1, "seconds": 1,
+			"min": 60, "minutes": 60, "h": 3600, "hours": 3600, "d": 86400, "days": 86400,
+		} {
+			v, name := convert(s, false, 1)
+			So(v, ShouldAlmostEqual, expected, expected*1e-12)
+			So(name, ShouldEqual, "seconds")
+		}
+
+		u, _ := parseUnit("ms", false)
+		So(u.time, ShouldBeTrue)
+		u, _ = parseUnit("ms/s", false)
+		So(u.time, ShouldBeFalse)
+	})
+
+	Convey("data units", t, func() {
+		for s, expected := range map[string]float64{
+			"B": 1, "byte": 1, "bytes": 1, "kB": 1e3, "KB": 1e3, "MB": 1e6, "GB": 1e9,
+			"KiB": 1024, "MiB": 1024 * 1024, "GiB": 1024 * 1024 * 1024,
+			"b": 0.125, "bits": 0.125, "kb": 125, "Mb": 125000, "Kibit": 128,
+		} {
+			v, name := convert(s, false, 1)
+			So(v, ShouldEqual, expected)
+			So(name, ShouldEqual, "bytes")
+		}
+
+		v, name := convert("KiB", true, 1)
+		So(v, ShouldEqual, 8192)
+		So(name, ShouldEqual, "bits")
+
+		v, name = convert("b", true, 1)
+		So(v, ShouldEqual, 1)
+		So(name, ShouldEqual, "bits")
+	})
+
+	Convey("rates", t, func() {
+		v, name := convert("MB/s", false, 1)
+		So(v, ShouldEqual, 1e6)
+		So(name, ShouldEqual, "bytes/second")
+
+		v, name = convert("KiB/min", true, 60)
+		So(v, ShouldEqual, 8192)
+		So(name, ShouldEqual, "bits/second")
+
+		v, name = convert("bytes/ms", false, 1)
+		So(v, ShouldEqual, 1000)
+		So(name, ShouldEqual, "bytes/second")
+
+		v, name = convert("requests/min", false, 120)
+		So(v, ShouldEqual, 2)
+		So(name, ShouldEqual, "requests/second")
+
+		v, name = convert("ms/s", false, 500)
+		So(v, ShouldEqual, 0.5)
+		So(name, ShouldEqual, "seconds/second")
+
+		v, name = convert("/s", false, 5)
+		So(v, ShouldEqual, 5)
+		So(name, ShouldEqual, "1/second")
+	})
+
+	Convey("other units", t, func() {
+		v, name := convert("%", false, 42)
+		So(v, ShouldEqual, 42)
+		So(name, ShouldEqual, "percent")
+
+		v, name = convert("", false, 42)
+		So(v, ShouldEqual, 42)
+		So(name, ShouldEqual, "")
+
+		v, name = convert("Ki", false, 1)
+		So(v, ShouldEqual, 1024)
+		So(name, ShouldEqual, "")
+
+		for _, s := range []string{"requests", "foo", "MB/foo", "kib"} {
+			_, ok := parseUnit(s, false)
+			So(ok, ShouldBeFalse)
+		}
+	})
+
+	Convey("metricUnit", t, func() {
+		timestamp := time.Unix(1, 0)
+
+		// Unit tag takes precedence over the unit of the metric type
+		input := *plugin.NewMetricType(core.NewNamespace("foo"), timestamp, map[string]string{"unit": "KiB/s"}, "ms", 1)
+		So(metricUnit(input), ShouldEqual, "KiB/s")
+
+		// Falls back to the unit of the metric type if there is no unit tag
+		input = *plugin.NewMetricType(core.NewNamespace("foo"), timestamp, map[string]string{"host": "foo"}, "ms", 1)
+		So(metricUnit(input), ShouldEqual, "ms")
+
+		input = *plugin.NewMetricType(core.NewNamespace("foo"), timestamp, nil, "", 1)
+		So(metricUnit(input), ShouldEqual, "")
+	})
+
+	Convey("toAtlasMetric with units", t, func() {
+		timestamp := time.Unix(1, 0)
+		values := &valueOptions{bits: true, unitTag: "unit"}
+
+		// Unit tag takes precedence over the unit of the metric type
+		input := *plugin.NewMetricType(core.NewNamespace("foo"), timestamp, map[string]string{"unit": "KiB/s"}, "ms", 1)
+		m, err := toAtlasMetric(input, nil, values)
+		So(err, ShouldBeNil)
+		So(*m, ShouldResemble, Metric{map[string]string{"name": "foo", "unit": "bits/second"}, 1000, 8192.0})
+
+		input = *plugin.NewMetricType(core.NewNamespace("foo"), timestamp, nil, "ms", 250)
+		m, err = toAtlasMetric(input, nil, values)
+		So(err, ShouldBeNil)
+		So(*m, ShouldResemble, Metric{map[string]string{"name": "foo", "unit": "seconds"}, 1000, 0.25})
+
+		// Unknown and dimensionless units are not added as a tag
+		input = *plugin.NewMetricType(core.NewNamespace("foo"), timestamp, nil, "requests", 5)
+		m, err = toAtlasMetric(input, nil, values)
+		So(err, ShouldBeNil)
+		So(*m, ShouldResemble, Metric{map[string]string{"name": "foo"}, 1000, 5.0})
+	})
+}
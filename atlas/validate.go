@@ -0,0 +1,227 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Prefix for tag keys that are reserved for use by Atlas.
+const reservedTagPrefix = "atlas."
+
+// Prefix for tag keys used for infrastructure tags. These do not count
+// towards the limit for user tags.
+const infrastructureTagPrefix = "nf."
+
+// Tag keys with the reserved prefix that can be set by the client.
+var allowedReservedTags = map[string]bool{
+	dstypeTag:      true,
+	"atlas.legacy": true,
+}
+
+// Settings for checking datapoints against the validation rules used by the
+// Atlas publish endpoint before they are sent.
+type ValidationOptions struct {
+	// Maximum number of user tags for a datapoint including the common tags.
+	// The name and tags with the nf. or atlas. prefix are not counted.
+	MaxUserTags int
+
+	// Maximum length of a tag key.
+	MaxKeyLength int
+
+	// Maximum length of a tag value.
+	MaxValueLength int
+
+	// Maximum age of a datapoint relative to the current time. Use 0 to
+	// disable the check.
+	MaxAge time.Duration
+
+	// Maximum amount a datapoint can be in the future relative to the current
+	// time. Use 0 to disable the check.
+	MaxFuture time.Duration
+
+	// If true, then datapoints with too many tags, keys or values that are
+	// too long, or reserved keys are fixed by removing tags and truncating
+	// strings. Otherwise, they are dropped. Datapoints without a name or with
+	// a timestamp outside the accepted range are always dropped.
+	Fix bool
+}
+
+// Returns the default validation settings. The limits match the defaults
+// for the Atlas publish endpoint.
+func DefaultValidationOptions() ValidationOptions {
+	return ValidationOptions{
+		MaxUserTags:    20,
+		MaxKeyLength:   60,
+		MaxValueLength: 120,
+	}
+}
+
+// Parse the action to take for datapoints that fail validation. Returns true
+// if they should be fixed.
+func parseInvalidAction(s string) (bool, error) {
+	switch s {
+	case "drop":
+		return false, nil
+	case "fix":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid action '%s', must be one of: drop, fix", s)
+	}
+}
+
+// Verify the limits are usable.
+func checkValidationOptions(options ValidationOptions) error {
+	if options.MaxUserTags <= 0 {
+		return fmt.Errorf("max_user_tags must be positive: %d", options.MaxUserTags)
+	}
+	if options.MaxKeyLength <= 0 {
+		return fmt.Errorf("max_key_length must be positive: %d", options.MaxKeyLength)
+	}
+	if options.MaxValueLength <= 0 {
+		return fmt.Errorf("max_value_length must be positive: %d", options.MaxValueLength)
+	}
+	if options.MaxAge < 0 || options.MaxFuture < 0 {
+		return fmt.Errorf("max_age_ms and max_future_ms cannot be negative")
+	}
+	return nil
+}
+
+// Returns true if the tag counts towards the limit for user tags.
+func isUserTag(k string) bool {
+	return k != "name" &&
+		!strings.HasPrefix(k, infrastructureTagPrefix) &&
+		!strings.HasPrefix(k, reservedTagPrefix)
+}
+
+// Count the number of user tags in the map.
+func countUserTags(tags map[string]string) int {
+	n := 0
+	for k := range tags {
+		if isUserTag(k) {
+			n++
+		}
+	}
+	return n
+}
+
+// Check the datapoint against the validation rules. The common tags is the
+// number of user tags from the common tags that will be added by the server.
+// If fixing is enabled, then the returned datapoint may have a new tag map
+// and the input is not modified. Returns an error if the datapoint should be
+// dropped.
+func (o *ValidationOptions) validate(m Metric, commonTags int, now time.Time) (Metric, error) {
+	if m.Tags["name"] == "" {
+		return m, errors.New("missing name")
+	}
+
+	nowMillis := now.UnixNano() / int64(time.Millisecond)
+	if o.MaxAge > 0 && int64(m.Timestamp) < nowMillis-int64(o.MaxAge/time.Millisecond) {
+		return m, fmt.Errorf("timestamp %d is older than %v", m.Timestamp, o.MaxAge)
+	}
+	if o.MaxFuture > 0 && int64(m.Timestamp) > nowMillis+int64(o.MaxFuture/time.Millisecond) {
+		return m, fmt.Errorf("timestamp %d is more than %v in the future", m.Timestamp, o.MaxFuture)
+	}
+
+	// The common tags cannot be fixed for a single datapoint
+	if commonTags > o.MaxUserTags {
+		return m, fmt.Errorf("%d user tags in the common tags exceeds limit of %d", commonTags, o.MaxUserTags)
+	}
+
+	// Process the keys in sorted order so that if truncated keys collide, the
+	// result does not depend on the map iteration order. The first key wins
+	// and a key that did not need to be truncated always takes precedence.
+	keys := make([]string, 0, len(m.Tags))
+	for k := range m.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	fixed := make(map[string]string, len(m.Tags))
+	for _, k := range keys {
+		v := m.Tags[k]
+		if strings.HasPrefix(k, reservedTagPrefix) && !allowedReservedTags[k] {
+			problems = append(problems, fmt.Sprintf("reserved key '%s'", k))
+			continue
+		}
+		if len(k) > o.MaxKeyLength {
+			problems = append(problems, fmt.Sprintf("key '%s' is longer than %d", k, o.MaxKeyLength))
+			k = k[:o.MaxKeyLength]
+			if _, ok := m.Tags[k]; ok {
+				continue
+			}
+			if _, ok := fixed[k]; ok {
+				continue
+			}
+		}
+		if len(v) > o.MaxValueLength {
+			problems = append(problems, fmt.Sprintf("value for '%s' is longer than %d", k, o.MaxValueLength))
+			v = v[:o.MaxValueLength]
+		}
+		fixed[k] = v
+	}
+
+	if n := countUserTags(fixed) + commonTags; n > o.MaxUserTags {
+		problems = append(problems, fmt.Sprintf("%d user tags exceeds limit of %d", n, o.MaxUserTags))
+
+		// Keep the tags that sort first so the result is deterministic
+		var userKeys []string
+		for k := range fixed {
+			if isUserTag(k) {
+				userKeys = append(userKeys, k)
+			}
+		}
+		sort.Strings(userKeys)
+		for _, k := range userKeys[o.MaxUserTags-commonTags:] {
+			delete(fixed, k)
+		}
+	}
+
+	if len(problems) == 0 {
+		return m, nil
+	}
+	if !o.Fix {
+		sort.Strings(problems)
+		return m, errors.New(strings.Join(problems, ", "))
+	}
+	return Metric{fixed, m.Timestamp, m.Value}, nil
+}
+
+// Check all of the datapoints and return the ones that should be sent along
+// with the number that were dropped and the error for the first one dropped.
+func (o *ValidationOptions) filter(metrics []Metric, commonTags map[string]string, now time.Time) ([]Metric, int, error) {
+	common := countUserTags(commonTags)
+	valid := make([]Metric, 0, len(metrics))
+	dropped := 0
+	var firstErr error
+	for _, m := range metrics {
+		v, err := o.validate(m, common, now)
+		if err != nil {
+			dropped++
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		valid = append(valid, v)
+	}
+	return valid, dropped, firstErr
+}
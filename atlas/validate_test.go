@@ -0,0 +1,243 @@
+/*
+ * Copyright 2016 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package atlas
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestValidate(t *testing.T) {
+
+	now := time.Unix(10000, 0)
+	timestamp := uint64(now.Unix() * 1000)
+
+	newTags := func(n int) map[string]string {
+		tags := map[string]string{"name": "foo"}
+		for i := 0; i < n; i++ {
+			tags[fmt.Sprintf("k%02d", i)] = "v"
+		}
+		return tags
+	}
+
+	Convey("parseInvalidAction", t, func() {
+		fix, err := parseInvalidAction("drop")
+		So(err, ShouldBeNil)
+		So(fix, ShouldBeFalse)
+		fix, err = parseInvalidAction("fix")
+		So(err, ShouldBeNil)
+		So(fix, ShouldBeTrue)
+		_, err = parseInvalidAction("foo")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("checkValidationOptions", t, func() {
+		So(checkValidationOptions(DefaultValidationOptions()), ShouldBeNil)
+
+		invalid := []func(o *ValidationOptions){
+			func(o *ValidationOptions) { o.MaxUserTags = 0 },
+			func(o *ValidationOptions) { o.MaxKeyLength = 0 },
+			func(o *ValidationOptions) { o.MaxValueLength = -1 },
+			func(o *ValidationOptions) { o.MaxAge = -time.Second },
+			func(o *ValidationOptions) { o.MaxFuture = -time.Second },
+		}
+		for _, f := range invalid {
+			options := DefaultValidationOptions()
+			f(&options)
+			So(checkValidationOptions(options), ShouldNotBeNil)
+		}
+	})
+
+	Convey("countUserTags", t, func() {
+		So(countUserTags(map[string]string{
+			"name":         "foo",
+			"nf.app":       "bar",
+			"atlas.dstype": "gauge",
+			"id":           "baz",
+		}), ShouldEqual, 1)
+	})
+
+	Convey("valid datapoints are unchanged", t, func() {
+		options := DefaultValidationOptions()
+		m := Metric{newTags(20), timestamp, 1.0}
+		m.Tags["nf.app"] = "foo"
+		m.Tags["atlas.dstype"] = "rate"
+		v, err := options.validate(m, 0, now)
+		So(err, ShouldBeNil)
+		So(v, ShouldResemble, m)
+	})
+
+	Convey("missing name", t, func() {
+		for _, fix := range []bool{false, true} {
+			options := DefaultValidationOptions()
+			options.Fix = fix
+			_, err := options.validate(Metric{map[string]string{"id": "foo"}, timestamp, 1.0}, 0, now)
+			So(err, ShouldNotBeNil)
+			_, err = options.validate(Metric{map[string]string{"name": ""}, timestamp, 1.0}, 0, now)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("timestamp limits", t, func() {
+		options := DefaultValidationOptions()
+		options.Fix = true
+
+		// Disabled by default
+		_, err := options.validate(Metric{newTags(0), 0, 1.0}, 0, now)
+		So(err, ShouldBeNil)
+
+		options.MaxAge = time.Hour
+		options.MaxFuture = time.Minute
+		_, err = options.validate(Metric{newTags(0), timestamp - 3600000, 1.0}, 0, now)
+		So(err, ShouldBeNil)
+		_, err = options.validate(Metric{newTags(0), timestamp - 3600001, 1.0}, 0, now)
+		So(err, ShouldNotBeNil)
+		_, err = options.validate(Metric{newTags(0), timestamp + 60000, 1.0}, 0, now)
+		So(err, ShouldBeNil)
+		_, err = options.validate(Metric{newTags(0), timestamp + 60001, 1.0}, 0, now)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("drop invalid tags", t, func() {
+		options := DefaultValidationOptions()
+		invalid := []map[string]string{
+			newTags(21),
+			map[string]string{"name": "foo", strings.Repeat("k", 61): "v"},
+			map[string]string{"name": "foo", "k": strings.Repeat("v", 121)},
+			map[string]string{"name": strings.Repeat("v", 121)},
+			map[string]string{"name": "foo", "atlas.foo": "bar"},
+		}
+		for _, tags := range invalid {
+			_, err := options.validate(Metric{tags, timestamp, 1.0}, 0, now)
+			So(err, ShouldNotBeNil)
+		}
+
+		// Common tags count towards the limit
+		_, err := options.validate(Metric{newTags(18), timestamp, 1.0}, 2, now)
+		So(err, ShouldBeNil)
+		_, err = options.validate(Metric{newTags(18), timestamp, 1.0}, 3, now)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("fix invalid tags", t, func() {
+		options := DefaultValidationOptions()
+		options.Fix = true
+		options.MaxUserTags = 2
+		options.MaxKeyLength = 12
+		options.MaxValueLength = 5
+
+		input := map[string]string{
+			"name":           "foobarbaz",
+			"nf.app":         "foo",
+			"atlas.dstype":   "gauge",
+			"atlas.foo":      "bar",
+			"abcdefghijklmn": "1",
+			"b":              "1234567",
+			"c":              "1",
+		}
+		v, err := options.validate(Metric{input, timestamp, 1.0}, 0, now)
+		So(err, ShouldBeNil)
+		So(v, ShouldResemble, Metric{map[string]string{
+			"name":         "fooba",
+			"nf.app":       "foo",
+			"atlas.dstype": "gauge",
+			"abcdefghijkl": "1",
+			"b":            "12345",
+		}, timestamp, 1.0})
+
+		// Input is not modified
+		So(len(input), ShouldEqual, 7)
+
+		// Only infrastructure tags kept if the common tags are at the limit
+		v, err = options.validate(Metric{newTags(3), timestamp, 1.0}, 2, now)
+		So(err, ShouldBeNil)
+		So(v.Tags, ShouldResemble, map[string]string{"name": "foo"})
+
+		// Dropped if the common tags alone exceed the limit
+		_, err = options.validate(Metric{newTags(0), timestamp, 1.0}, 3, now)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("fix truncated keys that collide", t, func() {
+		options := DefaultValidationOptions()
+		options.Fix = true
+		options.MaxKeyLength = 4
+
+		// Keys that collide after truncation, the first in sorted order wins
+		for i := 0; i < 20; i++ {
+			v, err := options.validate(Metric{map[string]string{
+				"name":  "foo",
+				"abcde": "1",
+				"abcdf": "2",
+				"abcdg": "3",
+			}, timestamp, 1.0}, 0, now)
+			So(err, ShouldBeNil)
+			So(v.Tags, ShouldResemble, map[string]string{"name": "foo", "abcd": "1"})
+		}
+
+		// Key that did not need to be truncated takes precedence
+		v, err := options.validate(Metric{map[string]string{
+			"name":  "foo",
+			"abcd":  "1",
+			"abcde": "2",
+		}, timestamp, 1.0}, 0, now)
+		So(err, ShouldBeNil)
+		So(v.Tags, ShouldResemble, map[string]string{"name": "foo", "abcd": "1"})
+	})
+
+	Convey("filter", t, func() {
+		options := DefaultValidationOptions()
+		metrics := []Metric{
+			Metric{map[string]string{"name": "a"}, timestamp, 1.0},
+			Metric{map[string]string{"id": "b"}, timestamp, 1.0},
+			Metric{map[string]string{"name": "c"}, timestamp, 1.0},
+		}
+		valid, dropped, err := options.filter(metrics, map[string]string{"nf.app": "foo"}, now)
+		So(valid, ShouldResemble, []Metric{metrics[0], metrics[2]})
+		So(dropped, ShouldEqual, 1)
+		So(err.Error(), ShouldEqual, "missing name")
+	})
+
+	Convey("publish drops invalid datapoints", t, func() {
+		validation := DefaultValidationOptions()
+		options := DefaultClientOptions()
+		options.Validation = &validation
+		options.Stats = &ClientStats{}
+		client := NewAtlasClientWithOptions("/api/v1/publish", map[string]string{}, options).(httpAtlasClient)
+
+		var sent []string
+		f := func(data []byte) error {
+			sent = append(sent, string(data))
+			return nil
+		}
+
+		_, err := client.publish([]Metric{Metric{map[string]string{"id": "foo"}, 0, 1.0}}, f)
+		So(err, ShouldBeNil)
+		So(sent, ShouldBeEmpty)
+
+		_, err = client.publish([]Metric{
+			Metric{map[string]string{"id": "foo"}, 0, 1.0},
+			Metric{map[string]string{"name": "foo"}, 0, 1.0},
+		}, f)
+		So(err, ShouldBeNil)
+		So(len(sent), ShouldEqual, 1)
+		So(options.Stats.counters[statID{"atlas.publisher.dropped", "reason", dropValidation}], ShouldEqual, 2.0)
+	})
+}
@@ -24,5 +24,7 @@ import (
 
 func main() {
 	meta := atlas.Meta()
-	plugin.Start(meta, atlas.NewAtlasPublisher(), os.Args[1])
+	publisher := atlas.NewAtlasPublisher()
+	plugin.Start(meta, publisher, os.Args[1])
+	publisher.Close()
 }